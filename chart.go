@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/facundoolano/ngtop/ngtop"
+)
+
+// The time fields that can be drawn as a line chart of requests over time, with the layout of their values.
+// The hour values are integers, so they don't have a layout.
+var CHART_TIME_FIELDS = map[string]string{
+	"hour":  "",
+	"date":  time.DateOnly,
+	"month": "2006-01",
+}
+
+// The width of charts when it can't be taken from the terminal.
+const DEFAULT_CHART_WIDTH = 80
+
+// The height of line charts, in lines.
+const CHART_HEIGHT = 12
+
+// The minimum width of the bars column of top charts, even if the table doesn't leave enough room for it.
+const MIN_BAR_WIDTH = 10
+
+// The partial blocks of the end of the bars, in eighths.
+var BAR_EIGHTHS = []string{"", "▏", "▎", "▍", "▌", "▋", "▊", "▉"}
+
+// Returns the width available to draw charts: the COLUMNS variable if set, otherwise the terminal width.
+func chartWidth() int {
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 0 {
+		return columns
+	}
+	if width := terminalWidth(); width > 0 {
+		return width
+	}
+	return DEFAULT_CHART_WIDTH
+}
+
+// Returns the time field of the query if its results can be drawn as a line chart, or an empty string otherwise.
+func timeSeriesField(spec *ngtop.RequestCountSpec) string {
+	if len(spec.GroupByMetrics) != 1 || spec.PivotMetric != "" {
+		return ""
+	}
+	if _, found := CHART_TIME_FIELDS[spec.GroupByMetrics[0]]; found {
+		return spec.GroupByMetrics[0]
+	}
+	return ""
+}
+
+// Returns a horizontal bar of the given count relative to the maximum, at most width characters long.
+func bar(count int, maxCount int, width int) string {
+	if maxCount <= 0 {
+		return ""
+	}
+	eighths := count * width * 8 / maxCount
+	return strings.Repeat("█", eighths/8) + BAR_EIGHTHS[eighths%8]
+}
+
+// Returns the width of the given table as printed by printTable.
+func tableWidth(columnNames []string, rowValues [][]string) int {
+	width := 0
+	for i, name := range columnNames {
+		columnWidth := utf8.RuneCountInString(name)
+		for _, row := range rowValues {
+			columnWidth = max(columnWidth, utf8.RuneCountInString(row[i]))
+		}
+		width += columnWidth + 1
+	}
+	return width
+}
+
+// Returns the values of the time field that cover the results, from the window start to its end, or from the
+// first to the last result if the window is unbounded, so the requests over time can be charted without gaps.
+// The hour values always go from 0 to 23.
+func timeSeries(field string, results map[string]int, since time.Time, until time.Time, location *time.Location) []string {
+	layout := CHART_TIME_FIELDS[field]
+	if layout == "" {
+		series := make([]string, 24)
+		for hour := range 24 {
+			series[hour] = strconv.Itoa(hour)
+		}
+		return series
+	}
+
+	var values []string
+	for value := range results {
+		values = append(values, value)
+	}
+	slices.Sort(values)
+	var first, last time.Time
+	if len(values) > 0 {
+		var err error
+		if first, err = time.ParseInLocation(layout, values[0], location); err != nil {
+			return values
+		}
+		if last, err = time.ParseInLocation(layout, values[len(values)-1], location); err != nil {
+			return values
+		}
+	}
+	if !since.IsZero() {
+		first = since.In(location)
+	}
+	if until.After(since) {
+		last = until.Add(-time.Nanosecond).In(location)
+	}
+	if first.IsZero() {
+		return nil
+	}
+
+	var series []string
+	for t := first; t.Format(layout) <= last.Format(layout); {
+		series = append(series, t.Format(layout))
+		if field == "date" {
+			t = t.AddDate(0, 0, 1)
+		} else {
+			// from the start of the month, so adding one doesn't overflow into the next one
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, location)
+		}
+	}
+	return series
+}
+
+// Draw a line chart of the request counts of the given time field results, with a point for each value of the
+// time series and the maximum count on the y axis.
+// The lines are drawn with braille characters, which have 2x4 dots each.
+func printLineChart(w io.Writer, series []string, results map[string]int, width int) {
+	counts := make([]int, len(series))
+	maxCount := 1
+	for i, value := range series {
+		counts[i] = results[value]
+		maxCount = max(maxCount, counts[i])
+	}
+
+	maxLabel := prettyPrintCount(strconv.Itoa(maxCount))
+	labelWidth := max(utf8.RuneCountInString(maxLabel), 1)
+	plotWidth := max(width-labelWidth-2, MIN_BAR_WIDTH)
+	dotsX, dotsY := plotWidth*2, CHART_HEIGHT*4
+
+	dots := make([][]bool, dotsY)
+	for y := range dots {
+		dots[y] = make([]bool, dotsX)
+	}
+	point := func(i int) (int, int) {
+		x := 0
+		if len(counts) > 1 {
+			x = i * (dotsX - 1) / (len(counts) - 1)
+		}
+		return x, (dotsY - 1) - counts[i]*(dotsY-1)/maxCount
+	}
+	for i := range counts {
+		x1, y1 := point(i)
+		x0, y0 := x1, y1
+		if i > 0 {
+			x0, y0 = point(i - 1)
+		}
+		// draw the segment from the previous point
+		steps := max(abs(x1-x0), abs(y1-y0), 1)
+		for step := range steps + 1 {
+			dots[y0+(y1-y0)*step/steps][x0+(x1-x0)*step/steps] = true
+		}
+	}
+
+	brailleBits := [4][2]rune{{0x01, 0x08}, {0x02, 0x10}, {0x04, 0x20}, {0x40, 0x80}}
+	for line := range CHART_HEIGHT {
+		label := ""
+		axis := "│"
+		if line == 0 {
+			label, axis = maxLabel, "┤"
+		}
+		chars := make([]rune, plotWidth)
+		for i := range chars {
+			char := rune(0x2800)
+			for dy := range 4 {
+				for dx := range 2 {
+					if dots[line*4+dy][i*2+dx] {
+						char |= brailleBits[dy][dx]
+					}
+				}
+			}
+			chars[i] = char
+		}
+		fmt.Fprintf(w, "%*s %s%s\n", labelWidth, label, axis, string(chars))
+	}
+	fmt.Fprintf(w, "%*s %s%s\n", labelWidth, "0", "└", strings.Repeat("─", plotWidth))
+
+	if len(series) > 0 {
+		first, last := series[0], series[len(series)-1]
+		padding := plotWidth - utf8.RuneCountInString(first) - utf8.RuneCountInString(last)
+		if len(series) == 1 || padding < 1 {
+			last, padding = "", 0
+		}
+		fmt.Fprintf(w, "%*s  %s%s%s\n", labelWidth, "", first, strings.Repeat(" ", padding), last)
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
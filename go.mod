@@ -5,6 +5,6 @@ go 1.22.4
 require github.com/alecthomas/kong v0.9.0
 
 require (
-	github.com/mattn/go-sqlite3 v1.14.22 // indirect
+	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/mileusna/useragent v1.3.4
 )
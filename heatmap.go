@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The rows of the heatmap, in the same format as the `weekday` field values.
+var HEATMAP_WEEKDAYS = []string{"mon", "tue", "wed", "thu", "fri", "sat", "sun"}
+
+// The shades of the heatmap cells, from the lowest non zero counts to the highest.
+// Plain text uses unicode blocks, terminals 256-color backgrounds.
+var HEATMAP_SHADES = []string{"░░", "▒▒", "▓▓", "██"}
+var HEATMAP_COLORS = []int{22, 28, 34, 40}
+
+// The background of cells without requests, when using colors.
+const HEATMAP_EMPTY_COLOR = 236
+
+// Print a grid of request counts with a row per weekday and a column per hour, from query results
+// grouped by weekday and hour. Each cell is shaded according to its count relative to the busiest hour.
+func printHeatmap(w io.Writer, rowValues [][]string, color bool) {
+	var counts [7][24]int
+	maxCount := 0
+	for _, row := range rowValues {
+		day := slices.Index(HEATMAP_WEEKDAYS, row[0])
+		hour, err := strconv.Atoi(row[1])
+		count, _ := strconv.Atoi(row[2])
+		if day < 0 || err != nil || hour < 0 || hour > 23 {
+			continue
+		}
+		counts[day][hour] = count
+		maxCount = max(maxCount, count)
+	}
+
+	cell := func(count int) string {
+		level := -1
+		if count > 0 {
+			// split the counts range evenly, rounding up so only the maximum gets the darkest shade
+			level = (count*len(HEATMAP_SHADES) - 1) / maxCount
+		}
+		if !color {
+			if level < 0 {
+				return "  "
+			}
+			return HEATMAP_SHADES[level]
+		}
+		background := HEATMAP_EMPTY_COLOR
+		if level >= 0 {
+			background = HEATMAP_COLORS[level]
+		}
+		return fmt.Sprintf("\x1b[48;5;%dm  \x1b[0m", background)
+	}
+
+	fmt.Fprint(w, "   ")
+	for hour := range 24 {
+		fmt.Fprintf(w, " %02d", hour)
+	}
+	fmt.Fprintln(w, "  #REQS")
+
+	for day, name := range HEATMAP_WEEKDAYS {
+		total := 0
+		cells := make([]string, 24)
+		for hour, count := range counts[day] {
+			cells[hour] = cell(count)
+			total += count
+		}
+		fmt.Fprintf(w, "%s %s  %s\n", strings.ToUpper(name), strings.Join(cells, " "), prettyPrintCount(strconv.Itoa(total)))
+	}
+
+	if maxCount == 0 {
+		return
+	}
+	// each shade covers up to a fraction of the maximum count, which may leave some empty for small counts
+	var legend []string
+	previous := 0
+	for level := range HEATMAP_SHADES {
+		upTo := maxCount * (level + 1) / len(HEATMAP_SHADES)
+		if upTo > previous {
+			legend = append(legend, fmt.Sprintf("%s ≤%s", cell(upTo), prettyPrintCount(strconv.Itoa(upTo))))
+			previous = upTo
+		}
+	}
+	fmt.Fprintf(w, "\n%s\n", strings.Join(legend, "  "))
+}
+
+// Returns true if the standard output is a terminal, unless colors are disabled with the NO_COLOR variable.
+func colorOutput() bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
 	"text/tabwriter"
 	"time"
 
@@ -17,13 +23,110 @@ import (
 	"github.com/facundoolano/ngtop/ngtop"
 )
 
-type CommandArgs struct {
-	Fields []string `arg:"" name:"field" optional:"" enum:"${fields}" help:"Dimensions to aggregate the results. Allowed values: ${fields} "`
-	Since  string   `short:"s" default:"1h" help:"Start of the time window to filter logs. Supported units are [s]econds, [m]inutes, [h]ours, [d]ays, [w]eeks, [M]onths"`
-	Until  string   `short:"u" default:"now"  help:"End of the time window to filter logs. Supported units are [s]econds, [m]inutes, [h]ours, [d]ays, [w]eeks, [M]onths"`
-	Limit  int      `short:"l" default:"5" help:"Amount of results to return"`
-	Where  []string `short:"w" optional:"" help:"Filter expressions. Example: -w useragent=Safari -w status=200"`
+type CLI struct {
+	Query   QueryCmd         `cmd:"" default:"withargs" help:"Print request counts from the access logs. This is the default command."`
+	Ingest  IngestCmd        `cmd:"" help:"Load the new entries of the access logs into the DB, without querying it. E.g. to update the DB from a cron job."`
+	Status  StatusCmd        `cmd:"" help:"Print a summary of the DB contents."`
+	Prune   PruneCmd         `cmd:"" help:"Delete the data older than the retention settings, keeping the aggregated counts of the deleted logs."`
+	Heatmap HeatmapCmd       `cmd:"" help:"Print a grid of request counts by weekday and hour of the day."`
+	Logs    LogsCmd          `cmd:"" help:"Print the log entries that match the filters, in time order."`
+	Rejects RejectsCmd       `cmd:"" help:"Print the log lines that couldn't be parsed, grouped by reason."`
+	SQL     SQLCmd           `cmd:"" name:"sql" help:"Run a read-only SQL query against the DB."`
+	Schema  SchemaCmd        `cmd:"" help:"Print the columns and tables of the DB, to write queries for the sql command."`
+	Fields  FieldsCmd        `cmd:"" help:"Print the fields available in the log format, with how many of the stored entries have values of them."`
+	Serve   ServeCmd         `cmd:"" help:"Run an HTTP server that accepts log batches from log shippers like Vector or Fluent Bit."`
+	Reindex ReindexCmd       `cmd:"" help:"Recompute derived fields, like user agent details or request paths, from the raw values stored in the DB."`
 	Version kong.VersionFlag `short:"v"`
+	TZ      string           `name:"tz" help:"Timezone used to compute day boundaries and to display times, e.g. Europe/Madrid. Defaults to the local timezone."`
+}
+
+type QueryCmd struct {
+	Fields       []string `arg:"" name:"field" optional:"" enum:"${fields}" help:"Dimensions to aggregate the results. Allowed values: ${fields} "`
+	Since        string   `short:"s" default:"1h" help:"Start of the time window to filter logs. ${time_formats}"`
+	Until        string   `short:"u" default:"now"  help:"End of the time window to filter logs. ${time_formats}"`
+	Limit        int      `short:"l" default:"5" help:"Amount of results to return"`
+	Offset       int      `help:"Amount of results to skip, e.g. to get the next page of results. With --per, amount of groups to skip."`
+	Per          []string `enum:"${fields}" help:"Query fields to split the results into groups, showing the top --limit results of each group. Example: ngtop url referer --per url"`
+	Groups       int      `default:"5" help:"Amount of groups to return when using --per"`
+	Pivot        string   `help:"Query field to show as columns, with the request counts of each of its values. Example: ngtop url status --pivot status"`
+	PivotColumns int      `default:"5" help:"Amount of --pivot values to show as columns. The requests of the rest are added up in an (other) column."`
+	Spark        bool     `help:"Add a column with a sparkline of the requests of each result over the time window."`
+	Chart        bool     `help:"Draw bars proportional to the request counts next to the results. Queries by a single hour, date or month field are drawn as a line chart of the requests over time, including every value in the time window."`
+	Where        []string `short:"w" optional:"" help:"Filter expressions. Example: -w useragent=Safari -w status=200"`
+	Sort         string   `default:"count" enum:"count,${fields}" help:"Sort the results by request count or by one of the query fields."`
+	Asc          bool     `help:"Sort the results in ascending order, e.g. to get the least requested items."`
+	MinCount     int      `help:"Only include the results with at least this amount of requests."`
+	MaxCount     int      `help:"Only include the results with at most this amount of requests."`
+	Percent      bool     `help:"Add a column with the percentage of the total requests of each result."`
+	Cumulative   bool     `help:"Add a column with the running sum of the percentages of the results. Can't be combined with --offset or the count thresholds."`
+	Other        bool     `help:"Add an (other) row with the requests not included in the results, so the rows add up to the total. Can't be combined with --offset or the count thresholds."`
+	QueryOptions `embed:""`
+}
+
+type HeatmapCmd struct {
+	Since        string   `short:"s" default:"4w" help:"Start of the time window to filter logs. ${time_formats}"`
+	Until        string   `short:"u" default:"now"  help:"End of the time window to filter logs. ${time_formats}"`
+	Where        []string `short:"w" optional:"" help:"Filter expressions. Example: -w useragent=Safari -w status=200"`
+	QueryOptions `embed:""`
+}
+
+type LogsCmd struct {
+	Fields       []string `arg:"" name:"field" optional:"" enum:"${fields}" help:"Fields to print after the time of each entry. Defaults to ip, method, path, status and user_agent, the ones of them in the log format."`
+	Since        string   `short:"s" default:"1h" help:"Start of the time window to filter logs. ${time_formats}"`
+	Until        string   `short:"u" default:"now"  help:"End of the time window to filter logs. ${time_formats}"`
+	Limit        int      `short:"l" default:"50" help:"Amount of entries to print, the most recent ones. 0 prints all of them."`
+	Where        []string `short:"w" optional:"" help:"Filter expressions. Example: -w useragent=Safari -w status=200"`
+	Follow       bool     `short:"f" help:"Keep printing the new matching entries, regardless of --until, until interrupted."`
+	QueryOptions `embed:""`
+}
+
+// Flags of the commands that query request counts, controlling how the DB is opened and queried.
+type QueryOptions struct {
+	Timeout  time.Duration `help:"Maximum time to wait for the query results, e.g. 30s. No limit by default."`
+	NoUpdate bool          `help:"Query the DB as is, without loading new entries from the access logs."`
+	Offline  bool          `help:"Open the DB in read-only mode and query it as is, e.g. to query a copy of it without access to the logs."`
+	Explain  bool          `help:"Print the SQL query with its arguments and the SQLite query plan, without loading the logs or running the query."`
+}
+
+type IngestCmd struct{}
+
+type StatusCmd struct{}
+
+type RejectsCmd struct{}
+
+type SQLCmd struct {
+	Query string `arg:"" help:"The SQL query, e.g. \"SELECT path, count(1) FROM v_requests GROUP BY path\". The DB is opened in read-only mode."`
+}
+
+type SchemaCmd struct{}
+
+type FieldsCmd struct{}
+
+type ServeCmd struct {
+	Addr string `short:"a" default:"127.0.0.1:8080" help:"Address to listen on, e.g. :8080 to accept batches from other hosts. Log batches are expected as POST requests to the /ingest path."`
+}
+
+type ReindexCmd struct {
+	Fields    []string `arg:"" name:"field" optional:"" enum:"${fields}" help:"Derived fields to recompute. Defaults to all of them."`
+	Since     string   `short:"s" help:"Only reindex logs after this time. ${time_formats}"`
+	Until     string   `short:"u" help:"Only reindex logs before this time. ${time_formats}"`
+	BatchSize int      `default:"1000" help:"Amount of distinct raw values to process on each transaction"`
+}
+
+type PruneCmd struct{}
+
+// Settings that aren't expected to change across command invocations, read from environment variables.
+type Config struct {
+	DBPath         string
+	LogPathPattern string
+	LogFormat      string
+	Rollups        bool
+	// Durations like `30d`, after which stored data is pruned. Empty values mean data is kept forever.
+	RetainLogs   string
+	RetainHourly string
+	RetainDaily  string
+	// The timezone of calendar dates and displayed times.
+	Location *time.Location
 }
 
 // Use a var to get current time, allowing for tests to override it
@@ -41,45 +144,65 @@ func main() {
 		log.Default().SetOutput(io.Discard)
 	}
 
-	dbPath := DEFAULT_DB_PATH
+	config := &Config{
+		DBPath:         DEFAULT_DB_PATH,
+		LogPathPattern: DEFAULT_PATH_PATTERN,
+		LogFormat:      DEFAULT_LOG_FORMAT,
+	}
 	if envPath := os.Getenv("NGTOP_DB"); envPath != "" {
-		dbPath = envPath
+		config.DBPath = envPath
 	}
-
-	logPathPattern := DEFAULT_PATH_PATTERN
 	if envLogsPath := os.Getenv("NGTOP_LOGS_PATH"); envLogsPath != "" {
-		logPathPattern = envLogsPath
+		config.LogPathPattern = envLogsPath
 	}
-
-	logFormat := DEFAULT_LOG_FORMAT
 	if envLogFormat := os.Getenv("NGTOP_LOG_FORMAT"); envLogFormat != "" {
-		logFormat = envLogFormat
+		config.LogFormat = envLogFormat
 	}
+	config.Rollups = os.Getenv("NGTOP_ROLLUPS") != ""
+	config.RetainLogs = os.Getenv("NGTOP_RETAIN_LOGS")
+	config.RetainHourly = os.Getenv("NGTOP_RETAIN_HOURLY")
+	config.RetainDaily = os.Getenv("NGTOP_RETAIN_DAILY")
 
-	parser := ngtop.NewParser(logFormat)
-
-	ctx, spec := querySpecFromCLI()
-	dbs, err := ngtop.InitDB(dbPath, parser.Fields)
-	ctx.FatalIfErrorf(err)
-	defer dbs.Close()
+	// the parser needs to be initialized before the CLI, since the format determines the available fields
+	parser := ngtop.NewParser(config.LogFormat)
+	if hint := statusHint(os.Args[1:]); hint != "" {
+		fmt.Fprintln(os.Stderr, hint)
+	}
+	ctx, cli := parseCLI()
+	config.Location = time.Local
+	if cli.TZ != "" {
+		location, err := time.LoadLocation(cli.TZ)
+		ctx.FatalIfErrorf(err)
+		config.Location = location
+	}
 
-	err = loadLogs(parser, logPathPattern, dbs)
-	ctx.FatalIfErrorf(err)
+	// cancel the running command on interrupt, so the ongoing transactions are rolled back before exiting
+	runCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		// restore the default behavior after the first signal, so a second one ends the process right away,
+		// e.g. if a slow query doesn't stop when cancelled
+		<-runCtx.Done()
+		stop()
+	}()
+	ctx.BindTo(runCtx, (*context.Context)(nil))
 
-	columnNames, rowValues, err := dbs.QueryTop(spec)
+	// errors from an interrupted command may come from the db operations cut short, instead of the context itself
+	err := ctx.Run(config, parser)
+	if err != nil && runCtx.Err() != nil {
+		err = errors.New("interrupted")
+	}
 	ctx.FatalIfErrorf(err)
-	printTopTable(columnNames, rowValues)
 }
 
-// Parse the command line arguments into a top requests query specification
-func querySpecFromCLI() (*kong.Context, *ngtop.RequestCountSpec) {
-	// Parse query spec first, i.e. don't bother with db updates if the command is invalid
+// Parse the command line arguments
+func parseCLI() (*kong.Context, *CLI) {
 	fieldNames := make([]string, 0, len(ngtop.CLI_NAME_TO_FIELD))
 	for k := range ngtop.CLI_NAME_TO_FIELD {
 		fieldNames = append(fieldNames, k)
 	}
 
-	cli := CommandArgs{}
+	cli := CLI{}
 	ctx := kong.Parse(
 		&cli,
 		kong.Description("ngtop prints request counts from nginx access.logs based on a command-line query"),
@@ -87,31 +210,788 @@ func querySpecFromCLI() (*kong.Context, *ngtop.RequestCountSpec) {
 		kong.Vars{
 			"version": "ngtop v0.4.6",
 			"fields":  strings.Join(fieldNames, ","),
+			"time_formats": "Supported values are durations relative to now in [s]econds, [m]inutes, [h]ours, [d]ays, [w]eeks or [M]onths (e.g. 2d), " +
+				"dates and times (e.g. 2024-07-01, \"2024-07-01 14:00\" or RFC 3339), " +
+				"and today, yesterday, this-week, last-week, this-month, last-month, this-year, last-year or all. " +
+				"Dates and keywords cover their whole period, e.g. --until yesterday ends at midnight.",
 		},
 	)
+	return ctx, &cli
+}
 
-	since, err := parseDuration(cli.Since)
-	ctx.FatalIfErrorf(err)
-	until, err := parseDuration(cli.Until)
-	ctx.FatalIfErrorf(err)
+// The status command used to be parsed as a query grouped by the status field, which now requires the explicit
+// query command. Returns a hint to use it if the status command is called with query arguments.
+func statusHint(args []string) string {
+	// skip the global flags before the command
+	for len(args) > 0 && strings.HasPrefix(args[0], "--tz") {
+		if args[0] == "--tz" && len(args) > 1 {
+			args = args[1:]
+		}
+		args = args[1:]
+	}
+	if len(args) < 2 || args[0] != "status" || slices.Contains(args, "-h") || slices.Contains(args, "--help") {
+		return ""
+	}
+	return fmt.Sprintf("hint: the status command prints a summary of the DB, to count requests by status run `ngtop query status %s`", strings.Join(args[1:], " "))
+}
+
+func (cmd *QueryCmd) Run(ctx context.Context, config *Config, parser *ngtop.LogParser) error {
+	// Parse query spec first, i.e. don't bother with db updates if the command is invalid
+	spec, err := cmd.querySpec(config.Location)
+	if err != nil {
+		return err
+	}
+	if cmd.Explain {
+		return cmd.explain(ctx, config, parser, specColumns(spec), func(ctx context.Context, dbs *ngtop.DBSession) (*ngtop.QueryExplanation, error) {
+			return dbs.ExplainTop(ctx, spec)
+		})
+	}
+
+	var columnNames []string
+	var rowValues [][]string
+	err = cmd.withDB(ctx, config, parser, specColumns(spec), func(ctx context.Context, dbs *ngtop.DBSession) error {
+		columnNames, rowValues, err = dbs.QueryTop(ctx, spec)
+		if err != nil || !cmd.Spark {
+			return err
+		}
+		trends, err := dbs.QueryTrends(ctx, spec, rowValues, SPARKLINE_BUCKETS)
+		if err != nil {
+			return err
+		}
+		columnNames = append(columnNames, "trend")
+		for i, row := range rowValues {
+			if spec.Other && i == len(rowValues)-1 && row[0] == ngtop.OTHER_RESULTS {
+				// the other results can't be told apart from the ones in the window
+				rowValues[i] = append(row, "")
+			} else {
+				rowValues[i] = append(row, sparkline(trends[i]))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if field := timeSeriesField(spec); cmd.Chart && field != "" {
+		results := make(map[string]int)
+		for _, row := range rowValues {
+			results[row[0]], _ = strconv.Atoi(row[1])
+		}
+		series := timeSeries(field, results, spec.TimeSince, spec.TimeUntil, spec.Location)
+		printLineChart(os.Stdout, series, results, chartWidth())
+		return nil
+	}
+	printTopTable(spec, columnNames, rowValues, cmd.Chart)
+	return nil
+}
+
+func (cmd *HeatmapCmd) Run(ctx context.Context, config *Config, parser *ngtop.LogParser) error {
+	spec, err := windowSpec(cmd.Since, cmd.Until, cmd.Where, config.Location)
+	if err != nil {
+		return err
+	}
+	spec.GroupByMetrics = []string{"weekday", "hour"}
+	spec.Limit = 7 * 24
+	if cmd.Explain {
+		return cmd.explain(ctx, config, parser, specColumns(spec), func(ctx context.Context, dbs *ngtop.DBSession) (*ngtop.QueryExplanation, error) {
+			return dbs.ExplainTop(ctx, spec)
+		})
+	}
+
+	var rowValues [][]string
+	err = cmd.withDB(ctx, config, parser, specColumns(spec), func(ctx context.Context, dbs *ngtop.DBSession) error {
+		_, rowValues, err = dbs.QueryTop(ctx, spec)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	printHeatmap(os.Stdout, rowValues, colorOutput())
+	return nil
+}
+
+// The fields printed by the logs command when none are given, if they are in the log format.
+var DEFAULT_LOGS_FIELDS = []string{"ip", "method", "path", "status", "user_agent"}
+
+// How often the logs command looks for new entries when following the logs.
+const FOLLOW_INTERVAL = 2 * time.Second
+
+func (cmd *LogsCmd) Run(ctx context.Context, config *Config, parser *ngtop.LogParser) error {
+	spec, err := windowSpec(cmd.Since, cmd.Until, cmd.Where, config.Location)
+	if err != nil {
+		return err
+	}
+	spec.Limit = cmd.Limit
+
+	var columns []string
+	for _, field := range cmd.Fields {
+		columns = append(columns, ngtop.CLI_NAME_TO_FIELD[field].ColumnName)
+	}
+	if len(columns) == 0 {
+		for _, column := range DEFAULT_LOGS_FIELDS {
+			if isFormatField(parser, column) {
+				columns = append(columns, column)
+			}
+		}
+	}
+	if cmd.Follow {
+		if cmd.Timeout > 0 {
+			return errors.New("--timeout can't be combined with --follow")
+		}
+		spec.TimeUntil = NowTimeFun()
+	}
+	if cmd.Explain {
+		return cmd.explain(ctx, config, parser, append(specColumns(spec), columns...), func(ctx context.Context, dbs *ngtop.DBSession) (*ngtop.QueryExplanation, error) {
+			return dbs.ExplainLogs(ctx, spec, columns)
+		})
+	}
+
+	return cmd.withDB(ctx, config, parser, append(specColumns(spec), columns...), func(ctx context.Context, dbs *ngtop.DBSession) error {
+		// following the logs only ends on interrupt, which may cut short the running query or update.
+		// Errors from the db operations may not wrap the context error, so check the context itself
+		followErr := func(err error) error {
+			if cmd.Follow && errors.Is(ctx.Err(), context.Canceled) {
+				return nil
+			}
+			return err
+		}
+
+		var cursor logsCursor
+		header := true
+		for {
+			columnNames, rowValues, err := dbs.QueryLogs(ctx, spec, columns)
+			if err != nil {
+				return followErr(err)
+			}
+			rowValues = cursor.advance(rowValues)
+			printLogs(columnNames, rowValues, config.Location, header)
+			header = false
+			if !cmd.Follow {
+				return nil
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(FOLLOW_INTERVAL):
+			}
+			if !cmd.Offline && !cmd.NoUpdate {
+				if _, err := updateDB(ctx, config, parser, dbs, false); err != nil {
+					return followErr(err)
+				}
+			}
+
+			// times are stored with second precision, so this includes the entries at the last printed time,
+			// which are skipped by the cursor
+			if lastTime, err := time.Parse(ngtop.DB_DATE_LAYOUT, cursor.time); err == nil {
+				spec.TimeSince = lastTime.Add(-time.Second)
+			} else {
+				spec.TimeSince = spec.TimeUntil
+			}
+			spec.TimeUntil = NowTimeFun()
+			spec.Limit = 0
+		}
+	})
+}
+
+// The position of the last printed entry, to skip the ones already printed when following the logs.
+type logsCursor struct {
+	time string
+	// the amount of printed entries at the last time
+	count int
+}
+
+// Returns the given entries, in time order, without the ones already printed, moving the cursor past them.
+func (cursor *logsCursor) advance(rows [][]string) [][]string {
+	skip := 0
+	for skip < len(rows) && skip < cursor.count && rows[skip][0] == cursor.time {
+		skip++
+	}
+	rows = rows[skip:]
+	for _, row := range rows {
+		if row[0] != cursor.time {
+			cursor.time = row[0]
+			cursor.count = 0
+		}
+		cursor.count++
+	}
+	return rows
+}
+
+// Print log entries as a table, with their times in the given location.
+// The header is only printed with the first entries, so new ones can be appended when following the logs.
+func printLogs(columnNames []string, rowValues [][]string, location *time.Location, header bool) {
+	tab := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	if header {
+		fmt.Fprintf(tab, "%s\n", strings.ToUpper(strings.Join(columnNames, "\t")))
+	}
+	for _, row := range rowValues {
+		if t, err := time.Parse(ngtop.DB_DATE_LAYOUT, row[0]); err == nil {
+			row[0] = t.In(location).Format(time.DateTime)
+		}
+		fmt.Fprintf(tab, "%s\n", strings.Join(row, "\t"))
+	}
+	tab.Flush()
+}
+
+// Open the DB, check the given query columns are stored in it, update it unless disabled by the options,
+// and run the given function to query it, interrupting it after the timeout, if any.
+func (options *QueryOptions) withDB(ctx context.Context, config *Config, parser *ngtop.LogParser, columns []string, query func(context.Context, *ngtop.DBSession) error) error {
+	var dbs *ngtop.DBSession
+	var err error
+	if options.Offline {
+		dbs, err = ngtop.OpenReadOnly(config.DBPath)
+	} else {
+		dbs, err = initDB(config, parser)
+	}
+	if err != nil {
+		return err
+	}
+	defer dbs.Close()
+	if err := checkAvailableFields(dbs, columns); err != nil {
+		return err
+	}
+
+	if !options.Offline && !options.NoUpdate && !options.Explain {
+		// if another process is already updating the db, e.g. a cron job, query the current data instead of waiting for it
+		if updated, err := updateDB(ctx, config, parser, dbs, false); err != nil {
+			return err
+		} else if !updated {
+			log.Println("the db is being updated by another process, skipping log loading")
+		}
+	}
+
+	if options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.Timeout)
+		defer cancel()
+	}
+	err = query(ctx, dbs)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("the query didn't finish after %s", options.Timeout)
+	}
+	return err
+}
+
+// Print the query of a command, as returned by the given function, and its plan.
+// The DB is opened as for running the query, but the logs aren't loaded.
+func (options *QueryOptions) explain(ctx context.Context, config *Config, parser *ngtop.LogParser, columns []string, explain func(context.Context, *ngtop.DBSession) (*ngtop.QueryExplanation, error)) error {
+	return options.withDB(ctx, config, parser, columns, func(ctx context.Context, dbs *ngtop.DBSession) error {
+		explanation, err := explain(ctx, dbs)
+		if err != nil {
+			return err
+		}
+		printExplanation(os.Stdout, explanation)
+		return nil
+	})
+}
+
+func (cmd *IngestCmd) Run(ctx context.Context, config *Config, parser *ngtop.LogParser) error {
+	dbs, err := initDB(config, parser)
+	if err != nil {
+		return err
+	}
+	defer dbs.Close()
+
+	_, err = updateDB(ctx, config, parser, dbs, true)
+	return err
+}
+
+func (cmd *StatusCmd) Run(ctx context.Context, config *Config) error {
+	dbs, err := ngtop.OpenReadOnly(config.DBPath)
+	if err != nil {
+		return err
+	}
+	defer dbs.Close()
+
+	status, err := dbs.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return "-"
+		}
+		return t.In(config.Location).Format(time.DateTime)
+	}
+	tab := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	fmt.Fprintf(tab, "db:\t%s\n", config.DBPath)
+	fmt.Fprintf(tab, "db size:\t%s\n", prettyPrintSize(status.Size))
+	fmt.Fprintf(tab, "log entries:\t%d\n", status.Entries)
+	fmt.Fprintf(tab, "first entry:\t%s\n", formatTime(status.FirstTime))
+	fmt.Fprintf(tab, "last entry:\t%s\n", formatTime(status.LastTime))
+	fmt.Fprintf(tab, "last ingestion:\t%s\n", formatTime(status.IngestedAt))
+	if err := tab.Flush(); err != nil {
+		return err
+	}
+	if len(status.IngestedFiles) == 0 {
+		return nil
+	}
+
+	fmt.Println()
+	var rows [][]string
+	for _, file := range status.IngestedFiles {
+		rows = append(rows, []string{file.Path, strconv.Itoa(file.Lines), strconv.Itoa(file.Processed), strconv.Itoa(file.Skipped)})
+	}
+	printTable([]string{"file", "lines", "new entries", "skipped"}, rows)
+
+	for _, file := range status.IngestedFiles {
+		if file.Skipped == 0 {
+			continue
+		}
+		fmt.Printf("\nskipped lines in %s", file.Path)
+		if file.Skipped > len(file.SkippedSamples) {
+			fmt.Printf(" (first %d of %d)", len(file.SkippedSamples), file.Skipped)
+		}
+		fmt.Println(":")
+		for _, line := range file.SkippedSamples {
+			fmt.Printf("  %s\n", escapeLine(line))
+		}
+	}
+	return nil
+}
+
+// Escape the control and non-ASCII characters of a log line, so untrusted input can't mess with the terminal.
+func escapeLine(line string) string {
+	quoted := strconv.QuoteToASCII(line)
+	return quoted[1 : len(quoted)-1]
+}
+
+func (cmd *RejectsCmd) Run(ctx context.Context, config *Config) error {
+	dbs, err := ngtop.OpenReadOnly(config.DBPath)
+	if err != nil {
+		return err
+	}
+	defer dbs.Close()
+
+	columnNames, rowValues, err := dbs.QueryRejects(ctx)
+	if err != nil {
+		return err
+	}
+	// the times are stored in UTC
+	for _, row := range rowValues {
+		if t, err := time.Parse(time.DateTime, row[2]); err == nil {
+			row[2] = t.In(config.Location).Format(time.DateTime)
+		}
+		row[4] = escapeLine(row[4])
+	}
+	printTable(columnNames, rowValues)
+	return nil
+}
+
+func (cmd *SQLCmd) Run(ctx context.Context, config *Config) error {
+	dbs, err := ngtop.OpenReadOnly(config.DBPath)
+	if err != nil {
+		return err
+	}
+	defer dbs.Close()
+
+	columnNames, rowValues, err := dbs.QuerySQL(ctx, cmd.Query)
+	if err != nil {
+		return err
+	}
+	printTable(columnNames, rowValues)
+	return nil
+}
+
+func (cmd *SchemaCmd) Run(parser *ngtop.LogParser) error {
+	// the known fields, followed by the unknown variables of the log format
+	var fields []*ngtop.LogField
+	for i := range ngtop.KNOWN_FIELDS {
+		fields = append(fields, &ngtop.KNOWN_FIELDS[i])
+	}
+	fields = append(fields, parser.Fields...)
+
+	var rows [][]string
+	seen := make(map[string]bool)
+	for _, field := range fields {
+		if seen[field.ColumnName] {
+			continue
+		}
+		seen[field.ColumnName] = true
+		columnType := field.ColumnSpec
+		if field.Expression != "" {
+			columnType = "virtual"
+		}
+		// document the columns by their name in the requests view, which is the one meant to be queried
+		description := field.Description
+		if name := ngtop.ViewColumnName(field.ColumnName); name != field.ColumnName {
+			description += fmt.Sprintf(" Stored as %s in access_logs.", field.ColumnName)
+		}
+		rows = append(rows, []string{ngtop.ViewColumnName(field.ColumnName), columnType, strings.Join(ngtop.ColumnSources(field.ColumnName), ", "), description})
+	}
+	printTable([]string{"column", "type", "source", "description"}, rows)
+
+	fmt.Println()
+	rows = nil
+	for _, table := range ngtop.SCHEMA_TABLES {
+		rows = append(rows, []string{table.Name, table.Description})
+	}
+	printTable([]string{"table", "description"}, rows)
+	return nil
+}
+
+func (cmd *FieldsCmd) Run(ctx context.Context, config *Config, parser *ngtop.LogParser) error {
+	fields := parser.AvailableFields()
+	columns := make([]string, len(fields))
+	for i, field := range fields {
+		columns[i] = field.ColumnName
+	}
+
+	dbs, err := ngtop.OpenReadOnly(config.DBPath)
+	if err != nil {
+		return err
+	}
+	defer dbs.Close()
+	total, stats, err := dbs.FieldStats(ctx, columns, config.Location)
+	if err != nil {
+		return err
+	}
+
+	var rows [][]string
+	for _, field := range fields {
+		columnType := field.ColumnSpec
+		if field.Expression != "" {
+			columnType = "virtual"
+		}
+		// fields of the format that haven't been stored yet don't have a column
+		filled, distinct := "-", "-"
+		if fieldStats, found := stats[field.ColumnName]; found {
+			filled = "0.0%"
+			if total > 0 {
+				filled = fmt.Sprintf("%.1f%%", float64(fieldStats.Populated)*100/float64(total))
+			}
+			distinct = strconv.FormatInt(fieldStats.Distinct, 10)
+		}
+		rows = append(rows, []string{
+			field.ColumnName,
+			strings.Join(field.CLINames, ","),
+			strings.Join(parser.FieldSources(field.ColumnName), ", "),
+			columnType,
+			filled,
+			distinct,
+		})
+	}
+	printTable([]string{"field", "aliases", "source", "type", "filled", "distinct"}, rows)
+	return nil
+}
+
+func (cmd *ServeCmd) Run(ctx context.Context, config *Config, parser *ngtop.LogParser) error {
+	dbs, err := initDB(config, parser)
+	if err != nil {
+		return err
+	}
+	defer dbs.Close()
+
+	mux := http.NewServeMux()
+	mux.Handle("/ingest", ngtop.NewIngestHandler(parser, dbs))
+	server := &http.Server{Addr: cmd.Addr, Handler: mux}
+
+	// on interrupt, stop accepting requests and let the batches in progress finish
+	shutdownErr := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		shutdownErr <- server.Shutdown(context.Background())
+	}()
+
+	fmt.Printf("listening for log batches at %s/ingest\n", cmd.Addr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return <-shutdownErr
+}
+
+func (cmd *ReindexCmd) Run(ctx context.Context, config *Config, parser *ngtop.LogParser) error {
+	columns := make([]string, len(cmd.Fields))
+	for i, field := range cmd.Fields {
+		columns[i] = ngtop.CLI_NAME_TO_FIELD[field].ColumnName
+		if !isDerivedField(parser, columns[i]) {
+			return fmt.Errorf("%s is not derived from another field in the log format", field)
+		}
+	}
+
+	var since, until *time.Time
+	if cmd.Since != "" {
+		t, err := parseTimeExpression(cmd.Since, config.Location, false)
+		if err != nil {
+			return err
+		}
+		since = &t
+	}
+	if cmd.Until != "" {
+		t, err := parseTimeExpression(cmd.Until, config.Location, true)
+		if err != nil {
+			return err
+		}
+		until = &t
+	}
+
+	// init the db with the parser fields, so columns of newly added derived fields are created before reindexing
+	dbs, err := initDB(config, parser)
+	if err != nil {
+		return err
+	}
+	defer dbs.Close()
+	if _, err := dbs.LockUpdates(true); err != nil {
+		return err
+	}
+
+	updatedCount, err := dbs.Reindex(ctx, parser, columns, since, until, cmd.BatchSize)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("updated %d log entries\n", updatedCount)
+	return nil
+}
+
+func (cmd *PruneCmd) Run(ctx context.Context, config *Config, parser *ngtop.LogParser) error {
+	if !config.hasRetention() {
+		return fmt.Errorf("no retention configured, set NGTOP_RETAIN_LOGS, NGTOP_RETAIN_HOURLY or NGTOP_RETAIN_DAILY")
+	}
+
+	dbs, err := initDB(config, parser)
+	if err != nil {
+		return err
+	}
+	defer dbs.Close()
+	if _, err := dbs.LockUpdates(true); err != nil {
+		return err
+	}
+
+	result, err := pruneDB(ctx, config, dbs)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("deleted %d log entries, %d hourly and %d daily aggregates, %d rejected lines\n", result.Logs, result.Hourly, result.Daily, result.Rejected)
+	return nil
+}
+
+// Load the new log entries into the db and delete the expired data, while holding the update lock.
+// If `wait` is false and the lock is held by another process, nothing is done and false is returned.
+func updateDB(ctx context.Context, config *Config, parser *ngtop.LogParser, dbs *ngtop.DBSession, wait bool) (bool, error) {
+	locked, err := dbs.LockUpdates(wait)
+	if err != nil || !locked {
+		return false, err
+	}
+	defer dbs.UnlockUpdates()
+
+	if err := loadLogs(ctx, parser, config.LogPathPattern, dbs); err != nil {
+		return false, err
+	}
+	if config.hasRetention() {
+		if _, err := pruneDB(ctx, config, dbs); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Returns true if any of the retention settings is set.
+func (config *Config) hasRetention() bool {
+	return config.RetainLogs != "" || config.RetainHourly != "" || config.RetainDaily != ""
+}
+
+// Delete the data older than the configured retention durations.
+func pruneDB(ctx context.Context, config *Config, dbs *ngtop.DBSession) (*ngtop.PruneResult, error) {
+	var cutoffs ngtop.RetentionCutoffs
+	retentions := []struct {
+		setting string
+		value   string
+		cutoff  *time.Time
+	}{
+		{"NGTOP_RETAIN_LOGS", config.RetainLogs, &cutoffs.Logs},
+		{"NGTOP_RETAIN_HOURLY", config.RetainHourly, &cutoffs.Hourly},
+		{"NGTOP_RETAIN_DAILY", config.RetainDaily, &cutoffs.Daily},
+	}
+	for _, retention := range retentions {
+		if retention.value == "" {
+			continue
+		}
+		cutoff, err := parseDuration(retention.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", retention.setting, err)
+		}
+		*retention.cutoff = cutoff
+	}
+
+	result, err := dbs.Prune(ctx, cutoffs)
+	if err == nil {
+		log.Printf("pruned %d log entries, %d hourly and %d daily aggregates, %d rejected lines\n", result.Logs, result.Hourly, result.Daily, result.Rejected)
+	}
+	return result, err
+}
+
+// Returns the columns of the fields the spec groups and filters by.
+func specColumns(spec *ngtop.RequestCountSpec) []string {
+	columns := slices.Clone(spec.GroupByMetrics)
+	var whereColumns []string
+	for column := range spec.Where {
+		whereColumns = append(whereColumns, column)
+	}
+	slices.Sort(whereColumns)
+	return append(columns, whereColumns...)
+}
+
+// Fail if any of the given columns isn't stored in the DB, see `ngtop fields`,
+// instead of with the SQL error of querying a column that doesn't exist.
+func checkAvailableFields(dbs *ngtop.DBSession, columns []string) error {
+	for _, column := range columns {
+		if !dbs.HasField(column) {
+			return fmt.Errorf(
+				"the %s field isn't in the log format, it's taken from %s. Add it to NGTOP_LOG_FORMAT, or run `ngtop fields` to list the available fields",
+				column,
+				strings.Join(ngtop.ColumnSources(column), " or "),
+			)
+		}
+	}
+	return nil
+}
+
+// Returns true if the given column is one of the fields of the parser format, or derived from one of them.
+func isFormatField(parser *ngtop.LogParser, column string) bool {
+	for _, field := range parser.Fields {
+		if field.ColumnName == column {
+			return true
+		}
+	}
+	return isDerivedField(parser, column)
+}
+
+// Returns true if the given column is one of the derived fields of the parser format.
+func isDerivedField(parser *ngtop.LogParser, column string) bool {
+	for _, field := range parser.Fields {
+		if slices.Contains(field.DerivedFields, column) {
+			return true
+		}
+	}
+	return false
+}
+
+// Open the database configured in the environment, creating the columns for the given parser fields.
+func initDB(config *Config, parser *ngtop.LogParser) (*ngtop.DBSession, error) {
+	dbs, err := ngtop.InitDB(config.DBPath, parser.Fields)
+	if err != nil {
+		return nil, err
+	}
+	if config.Rollups {
+		dbs.EnableRollups()
+	}
+	return dbs, nil
+}
+
+// Turn the query command arguments into a top requests query specification.
+// Calendar dates are interpreted in the given location.
+func (cmd *QueryCmd) querySpec(location *time.Location) (*ngtop.RequestCountSpec, error) {
+	spec, err := windowSpec(cmd.Since, cmd.Until, cmd.Where, location)
+	if err != nil {
+		return nil, err
+	}
 
 	// translate field name aliases
-	columns := make([]string, len(cli.Fields))
-	for i, field := range cli.Fields {
+	columns := make([]string, len(cmd.Fields))
+	for i, field := range cmd.Fields {
 		columns[i] = ngtop.CLI_NAME_TO_FIELD[field].ColumnName
 	}
+	spec.GroupByMetrics = columns
 
-	whereConditions, err := resolveWhereConditions(cli.Where)
-	ctx.FatalIfErrorf(err)
+	if len(cmd.Per) > 0 {
+		// the group fields go first, so their values can be shown once per group
+		var perColumns, restColumns []string
+		for _, field := range cmd.Per {
+			column := ngtop.CLI_NAME_TO_FIELD[field].ColumnName
+			if !slices.Contains(columns, column) {
+				return nil, fmt.Errorf("can't group by %s, it's not one of the query fields", field)
+			}
+			if !slices.Contains(perColumns, column) {
+				perColumns = append(perColumns, column)
+			}
+		}
+		for _, column := range columns {
+			if !slices.Contains(perColumns, column) {
+				restColumns = append(restColumns, column)
+			}
+		}
+		if len(restColumns) == 0 {
+			return nil, errors.New("--per needs at least one other query field to get the top results of each group")
+		}
+		spec.GroupByMetrics = append(perColumns, restColumns...)
+		spec.PerMetrics = perColumns
+		spec.GroupLimit = cmd.Groups
+	}
+
+	if cmd.Pivot != "" {
+		field, found := ngtop.CLI_NAME_TO_FIELD[cmd.Pivot]
+		if !found || !slices.Contains(spec.GroupByMetrics, field.ColumnName) {
+			return nil, fmt.Errorf("can't pivot by %s, it's not one of the query fields", cmd.Pivot)
+		}
+		if len(spec.PerMetrics) > 0 {
+			return nil, errors.New("--pivot can't be combined with --per")
+		}
+		if len(spec.GroupByMetrics) == 1 {
+			return nil, errors.New("--pivot needs at least one other query field to group the rows")
+		}
+		// the pivot field goes last, after the ones that identify the rows
+		spec.GroupByMetrics = append(slices.DeleteFunc(spec.GroupByMetrics, func(column string) bool {
+			return column == field.ColumnName
+		}), field.ColumnName)
+		spec.PivotMetric = field.ColumnName
+		spec.PivotLimit = cmd.PivotColumns
+	}
+
+	if cmd.Sort != "count" {
+		spec.SortBy = ngtop.CLI_NAME_TO_FIELD[cmd.Sort].ColumnName
+		if !slices.Contains(columns, spec.SortBy) {
+			return nil, fmt.Errorf("can't sort by %s, it's not one of the query fields", cmd.Sort)
+		}
+	}
+	if (cmd.Other || cmd.Cumulative) && (cmd.Offset > 0 || cmd.MinCount > 0 || cmd.MaxCount > 0) {
+		// the skipped results would be added up as other, and left out of the running sum
+		return nil, errors.New("--other and --cumulative can't be combined with --offset, --min-count or --max-count")
+	}
+	spec.Ascending = cmd.Asc
+	spec.Limit = cmd.Limit
+	spec.Offset = cmd.Offset
+	spec.MinCount = cmd.MinCount
+	spec.MaxCount = cmd.MaxCount
+	spec.Percent = cmd.Percent
+	spec.Cumulative = cmd.Cumulative
+	spec.Other = cmd.Other
+
+	if cmd.Chart && timeSeriesField(spec) != "" {
+		// line charts need every result of the window, in chronological order
+		spec.SortBy = spec.GroupByMetrics[0]
+		spec.Ascending = true
+		spec.Limit = -1
+		spec.Offset = 0
+	}
+	return spec, nil
+}
+
+// Returns a query specification for the requests in the given time window that match the where conditions,
+// without grouping.
+func windowSpec(since string, until string, where []string, location *time.Location) (*ngtop.RequestCountSpec, error) {
+	sinceTime, err := parseTimeExpression(since, location, false)
+	if err != nil {
+		return nil, err
+	}
+	untilTime, err := parseTimeExpression(until, location, true)
+	if err != nil {
+		return nil, err
+	}
+
+	whereConditions, err := resolveWhereConditions(where)
+	if err != nil {
+		return nil, err
+	}
 
 	spec := &ngtop.RequestCountSpec{
-		GroupByMetrics: columns,
-		TimeSince:      since,
-		TimeUntil:      until,
-		Limit:          cli.Limit,
-		Where:          whereConditions,
+		TimeSince: sinceTime,
+		TimeUntil: untilTime,
+		Location:  location,
+		Where:     whereConditions,
 	}
-	return ctx, spec
+	return spec, nil
 }
 
 // Parse the -w conditions like "ua=Firefox" and "url=/blog%" into a mapping that can be used to query the database.
@@ -163,54 +1043,243 @@ func parseDuration(duration string) (time.Time, error) {
 		case "h":
 			t = t.Add(-time.Duration(number) * time.Hour)
 		case "d":
-			t = t.Add(-time.Duration(number) * time.Hour * 24)
+			t = t.AddDate(0, 0, -number)
 		case "w":
-			t = t.Add(-time.Duration(number) * time.Hour * 24 * 7)
+			t = t.AddDate(0, 0, -number*7)
 		case "M":
-			t = t.Add(-time.Duration(number) * time.Hour * 24 * 30)
+			t = t.AddDate(0, -number, 0)
 		}
 	}
 	return t, nil
 }
 
+// The layouts accepted for absolute times, along with the period they cover, zero for instants.
+// Layouts without timezone are interpreted in the location given to parseTimeExpression.
+var TIME_LAYOUTS = []struct {
+	layout   string
+	timezone bool
+	months   int
+	days     int
+}{
+	{layout: time.RFC3339, timezone: true},
+	{layout: "2006-01-02T15:04:05"},
+	{layout: "2006-01-02T15:04"},
+	{layout: time.DateTime},
+	{layout: "2006-01-02 15:04"},
+	{layout: time.DateOnly, days: 1},
+	{layout: "2006-01", months: 1},
+}
+
+// Parse the boundary of a time window, given as a duration relative to the current time (see parseDuration),
+// an absolute date or time, or a calendar keyword like `today` or `last-month`.
+// Dates and keywords refer to a period of time, e.g. `2024-07-01` or `yesterday` are whole days,
+// so their start is returned, or their end if `end` is true. Day boundaries are computed in the given location.
+func parseTimeExpression(expression string, location *time.Location, end bool) (time.Time, error) {
+	if t, err := parseDuration(expression); err == nil {
+		return t, nil
+	}
+
+	now := NowTimeFun().In(location)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+	weekStart := today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, location)
+	yearStart := time.Date(now.Year(), time.January, 1, 0, 0, 0, 0, location)
+
+	var start, periodEnd time.Time
+	switch expression {
+	case "all":
+		if end {
+			return now.UTC(), nil
+		}
+		return time.Time{}, nil
+	case "today":
+		start, periodEnd = today, today.AddDate(0, 0, 1)
+	case "yesterday":
+		start, periodEnd = today.AddDate(0, 0, -1), today
+	case "this-week":
+		start, periodEnd = weekStart, weekStart.AddDate(0, 0, 7)
+	case "last-week":
+		start, periodEnd = weekStart.AddDate(0, 0, -7), weekStart
+	case "this-month":
+		start, periodEnd = monthStart, monthStart.AddDate(0, 1, 0)
+	case "last-month":
+		start, periodEnd = monthStart.AddDate(0, -1, 0), monthStart
+	case "this-year":
+		start, periodEnd = yearStart, yearStart.AddDate(1, 0, 0)
+	case "last-year":
+		start, periodEnd = yearStart.AddDate(-1, 0, 0), yearStart
+	default:
+		found := false
+		for _, layout := range TIME_LAYOUTS {
+			var err error
+			if layout.timezone {
+				start, err = time.Parse(layout.layout, expression)
+			} else {
+				start, err = time.ParseInLocation(layout.layout, expression, location)
+			}
+			if err == nil {
+				periodEnd = start.AddDate(0, layout.months, layout.days)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return time.Time{}, fmt.Errorf("invalid time %s", expression)
+		}
+	}
+
+	if end {
+		return periodEnd.UTC(), nil
+	}
+	return start.UTC(), nil
+}
+
 // Parse the most recent nginx access.logs and insert the ones not previously seen into the DB.
-func loadLogs(parser *ngtop.LogParser, logPathPattern string, dbs *ngtop.DBSession) error {
+// If the context is cancelled, none of the entries are inserted.
+func loadLogs(ctx context.Context, parser *ngtop.LogParser, logPathPattern string, dbs *ngtop.DBSession) error {
 	logFiles, err := filepath.Glob(logPathPattern)
 	if err != nil {
 		return err
 	}
+	if len(logFiles) == 0 {
+		// don't touch the db, otherwise the entries of the last seen time would be removed and never added back
+		log.Printf("no log files found at %s\n", logPathPattern)
+		return nil
+	}
 
 	// Get the last log time to know when to stop parsing, and prepare a transaction to insert newer entries
-	lastSeenTime, err := dbs.PrepareForUpdate()
+	lastSeenTime, err := dbs.PrepareForUpdate(ctx)
 	if err != nil {
 		return err
 	}
 
 	insertCount := 0
-	err = parser.Parse(logFiles, lastSeenTime, func(values []any) error {
+	rejectCount := 0
+	fileStats, err := parser.Parse(ctx, logFiles, lastSeenTime, func(values []any) error {
 		insertCount++
 		return dbs.AddLogEntry(values)
+	}, func(rejected *ngtop.RejectedLine) error {
+		rejectCount++
+		return dbs.AddRejectedLine(rejected, NowTimeFun())
 	})
+	if err == nil {
+		err = dbs.RecordIngestedFiles(fileStats, NowTimeFun())
+	}
 
 	// Rollback or commit before returning, depending on the error value
 	err = dbs.FinishUpdate(err)
-	if err == nil && insertCount > 0 {
+	if err != nil {
+		return err
+	}
+	if insertCount > 0 {
 		log.Printf("inserted %d log entries\n", insertCount)
 	}
-	return err
+
+	// unlike the rest of the logs, always show this since it may mean the log format is wrong
+	if rejectCount > 0 {
+		fmt.Fprintf(os.Stderr, "warning: rejected %d lines that couldn't be parsed, run `ngtop rejects` for details\n", rejectCount)
+	}
+	return nil
+}
+
+// Print the query results as a table.
+// The values of the --per group fields are only shown in the first row of each group.
+// If chart is true, bars proportional to the request counts are drawn in the width left by the table.
+func printTopTable(spec *ngtop.RequestCountSpec, columnNames []string, rowValues [][]string, chart bool) {
+	groupColumns := len(spec.PerMetrics)
+	// pivot values are shown as count columns before the row total
+	countIndex := slices.Index(columnNames, "#reqs")
+	countsStart := countIndex
+	if spec.PivotMetric != "" {
+		countsStart = len(spec.GroupByMetrics) - 1
+	}
+
+	counts := make([]int, len(rowValues))
+	var previousGroup []string
+	for i, row := range rowValues {
+		counts[i], _ = strconv.Atoi(row[countIndex])
+		for i := countsStart; i <= countIndex; i++ {
+			// the values of the (other) row may be missing
+			if row[i] != "" {
+				row[i] = prettyPrintCount(row[i])
+			}
+		}
+		if groupColumns > 0 {
+			group := slices.Clone(row[:groupColumns])
+			if slices.Equal(group, previousGroup) {
+				clear(row[:groupColumns])
+			}
+			previousGroup = group
+		}
+	}
+
+	if chart && len(rowValues) > 0 {
+		width := max(chartWidth()-tableWidth(columnNames, rowValues)-1, MIN_BAR_WIDTH)
+		maxCount := slices.Max(counts)
+		columnNames = append(columnNames, "")
+		for i, row := range rowValues {
+			rowValues[i] = append(row, bar(counts[i], maxCount, width))
+		}
+	}
+	printTable(columnNames, rowValues)
 }
 
-// Print the query results as a table
-func printTopTable(columnNames []string, rowValues [][]string) {
+// The amount of time buckets shown by the --spark column.
+const SPARKLINE_BUCKETS = 24
+
+var SPARKLINE_BARS = []rune("▁▂▃▄▅▆▇█")
+
+// Draw the given counts as bars relative to their maximum, where only empty buckets get the lowest bar.
+func sparkline(counts []int) string {
+	maxCount := slices.Max(counts)
+	bars := make([]rune, len(counts))
+	for i, count := range counts {
+		level := 0
+		if count > 0 {
+			level = 1 + (count*(len(SPARKLINE_BARS)-1)-1)/maxCount
+		}
+		bars[i] = SPARKLINE_BARS[level]
+	}
+	return string(bars)
+}
+
+// Print the SQL query, its arguments and its plan, in the style of the sqlite3 CLI.
+func printExplanation(w io.Writer, explanation *ngtop.QueryExplanation) {
+	fmt.Fprintf(w, "%s\n\n", explanation.Query)
+	if len(explanation.Args) > 0 {
+		fmt.Fprintf(w, "args: %s\n\n", strings.Join(explanation.FormatArgs(), ", "))
+	}
+	fmt.Fprintln(w, "QUERY PLAN")
+	for _, step := range explanation.Plan {
+		fmt.Fprintln(w, step)
+	}
+}
+
+// Print the given rows as a table, with the column names as header
+func printTable(columnNames []string, rowValues [][]string) {
 	tab := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
 	fmt.Fprintf(tab, "%s\n", strings.ToUpper(strings.Join(columnNames, "\t")))
 	for _, row := range rowValues {
-		row[len(row)-1] = prettyPrintCount(row[len(row)-1])
 		fmt.Fprintf(tab, "%s\n", strings.Join(row, "\t"))
 	}
 	tab.Flush()
 }
 
+// Format a size in bytes using binary units, e.g. 1.5MB.
+func prettyPrintSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	magnitude := 0
+	for value >= 1024 && magnitude < len(units)-1 {
+		value /= 1024
+		magnitude++
+	}
+	if magnitude == 0 {
+		return fmt.Sprintf("%d%s", size, units[0])
+	}
+	return fmt.Sprintf("%.1f%s", value, units[magnitude])
+}
+
 func prettyPrintCount(countStr string) string {
 	// FIXME some unnecessary work, first db stringifies, then this parses to int, then formats again.
 	// this suggests the query implementation and/or APIs could be made smarter
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -57,13 +63,16 @@ func TestDurationParsing(t *testing.T) {
 	assertEqual(t, nil, err)
 	assertEqual(t, duration, time.Date(2024, time.July, 10, 0, 7, 0, 0, time.UTC))
 
-	// (months are just 30 days not actual calendar months)
+	// months are calendar months
 	duration, err = parseDuration("1M")
 	assertEqual(t, nil, err)
 	assertEqual(t, duration, time.Date(2024, time.June, 24, 0, 7, 0, 0, time.UTC))
 	duration, err = parseDuration("2M")
 	assertEqual(t, nil, err)
-	assertEqual(t, duration, time.Date(2024, time.May, 25, 0, 7, 0, 0, time.UTC))
+	assertEqual(t, duration, time.Date(2024, time.May, 24, 0, 7, 0, 0, time.UTC))
+	duration, err = parseDuration("5M")
+	assertEqual(t, nil, err)
+	assertEqual(t, duration, time.Date(2024, time.February, 24, 0, 7, 0, 0, time.UTC))
 
 	// fail on unknown unit
 	_, err = parseDuration("1x")
@@ -74,6 +83,58 @@ func TestDurationParsing(t *testing.T) {
 	assert(t, err != nil)
 }
 
+func TestTimeExpressionParsing(t *testing.T) {
+	madrid, err := time.LoadLocation("Europe/Madrid")
+	assertEqual(t, err, nil)
+	newYork, err := time.LoadLocation("America/New_York")
+	assertEqual(t, err, nil)
+	utcDate := func(month time.Month, day int, hour int, minute int) time.Time {
+		return time.Date(2024, month, day, hour, minute, 0, 0, time.UTC)
+	}
+	assertParsed := func(expression string, location *time.Location, start time.Time, end time.Time) {
+		t.Helper()
+		parsed, err := parseTimeExpression(expression, location, false)
+		assertEqual(t, err, nil)
+		assertEqual(t, parsed, start)
+		parsed, err = parseTimeExpression(expression, location, true)
+		assertEqual(t, err, nil)
+		assertEqual(t, parsed, end)
+	}
+
+	// relative durations are the same regardless of the period end
+	assertParsed("now", madrid, utcDate(time.July, 24, 0, 7), utcDate(time.July, 24, 0, 7))
+	assertParsed("2d", madrid, utcDate(time.July, 22, 0, 7), utcDate(time.July, 22, 0, 7))
+
+	// the current time is Wednesday 2024-07-24 00:07 UTC
+	assertParsed("today", time.UTC, utcDate(time.July, 24, 0, 0), utcDate(time.July, 25, 0, 0))
+	assertParsed("yesterday", time.UTC, utcDate(time.July, 23, 0, 0), utcDate(time.July, 24, 0, 0))
+	assertParsed("this-week", time.UTC, utcDate(time.July, 22, 0, 0), utcDate(time.July, 29, 0, 0))
+	assertParsed("last-week", time.UTC, utcDate(time.July, 15, 0, 0), utcDate(time.July, 22, 0, 0))
+	assertParsed("this-month", time.UTC, utcDate(time.July, 1, 0, 0), utcDate(time.August, 1, 0, 0))
+	assertParsed("last-month", time.UTC, utcDate(time.June, 1, 0, 0), utcDate(time.July, 1, 0, 0))
+	assertParsed("this-year", time.UTC, utcDate(time.January, 1, 0, 0), time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC))
+	assertParsed("last-year", time.UTC, time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC), utcDate(time.January, 1, 0, 0))
+	assertParsed("all", time.UTC, time.Time{}, utcDate(time.July, 24, 0, 7))
+
+	// day boundaries depend on the timezone, which may also change the current day
+	assertParsed("today", madrid, utcDate(time.July, 23, 22, 0), utcDate(time.July, 24, 22, 0))
+	assertParsed("today", newYork, utcDate(time.July, 23, 4, 0), utcDate(time.July, 24, 4, 0))
+	assertParsed("this-month", newYork, utcDate(time.July, 1, 4, 0), utcDate(time.August, 1, 4, 0))
+
+	// absolute dates cover their period, times are instants
+	assertParsed("2024-07-01", time.UTC, utcDate(time.July, 1, 0, 0), utcDate(time.July, 2, 0, 0))
+	assertParsed("2024-07-01", madrid, utcDate(time.June, 30, 22, 0), utcDate(time.July, 1, 22, 0))
+	assertParsed("2024-07", time.UTC, utcDate(time.July, 1, 0, 0), utcDate(time.August, 1, 0, 0))
+	assertParsed("2024-07-01 14:00", madrid, utcDate(time.July, 1, 12, 0), utcDate(time.July, 1, 12, 0))
+	assertParsed("2024-07-01T14:00:00", time.UTC, utcDate(time.July, 1, 14, 0), utcDate(time.July, 1, 14, 0))
+	assertParsed("2024-07-01T14:00:00+05:00", madrid, utcDate(time.July, 1, 9, 0), utcDate(time.July, 1, 9, 0))
+
+	for _, invalid := range []string{"tomorrow", "2024-13-01", "1x", "2024-07-01 25:00"} {
+		_, err = parseTimeExpression(invalid, time.UTC, false)
+		assert(t, err != nil)
+	}
+}
+
 func TestWhereConditionParsing(t *testing.T) {
 	var cond map[string][]string
 	var err error
@@ -141,6 +202,15 @@ func TestDateFiltering(t *testing.T) {
 
 	_, rows = runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"-u", "1h"})
 	assertEqual(t, rows[0][0], "0")
+
+	_, rows = runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"-s", "today"})
+	assertEqual(t, rows[0][0], "11")
+
+	_, rows = runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"-s", "yesterday", "-u", "yesterday"})
+	assertEqual(t, rows[0][0], "0")
+
+	_, rows = runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"-s", "2024-07-24 00:01", "-u", "2024-07-24T00:05:00Z"})
+	assertEqual(t, rows[0][0], "5")
 }
 
 func TestLimit(t *testing.T) {
@@ -152,6 +222,170 @@ func TestLimit(t *testing.T) {
 	assertEqual(t, len(rows), 8) // not that many distinct urls
 }
 
+func TestSorting(t *testing.T) {
+	_, rows := runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"url", "--asc", "-l", "10"})
+	assertEqual(t, len(rows), 8)
+	assertEqual(t, rows[0][1], "1")
+	assertEqual(t, rows[6], []string{"/feed", "2"})
+	assertEqual(t, rows[7], []string{"/feed.xml", "3"})
+
+	_, rows = runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"url", "--sort", "url", "--asc", "-l", "3"})
+	assertEqual(t, rows, [][]string{{"/", "1"}, {"/blog/a-few-more-things-you-can-do-on-your-website", "1"}, {"/blog/a-note-on-essential-complexity", "1"}})
+	_, rows = runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"url", "--sort", "path", "--asc", "-l", "3", "--offset", "3"})
+	assertEqual(t, rows, [][]string{{"/blog/deconstructing-the-role-playing-videogame/", "1"}, {"/blog/mi-descubrimiento-de-america", "1"}, {"/blog/posdata-de-borges-y-bioy", "1"}})
+	_, rows = runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"url", "--sort", "url", "-l", "1"})
+	assertEqual(t, rows, [][]string{{"/feed.xml", "3"}})
+
+	// ties on the sort field are broken by count
+	_, rows = runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"method", "url", "--sort", "method", "-l", "2"})
+	assertEqual(t, rows, [][]string{{"GET", "/feed.xml", "3"}, {"GET", "/feed", "2"}})
+
+	// the sort field must be one of the query fields
+	os.Args = []string{"ngtop", "url", "--sort", "status"}
+	_, cli := parseCLI()
+	_, err := cli.Query.querySpec(time.UTC)
+	assertEqual(t, err.Error(), "can't sort by status, it's not one of the query fields")
+}
+
+func TestPerGroup(t *testing.T) {
+	columns, rows := runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"url", "status", "--per", "status", "-l", "2", "--sort", "url", "--asc"})
+	// the group fields come first
+	assertEqual(t, columns, []string{"status", "path", "#reqs"})
+	assertEqual(t, rows, [][]string{
+		{"301", "/blog/a-few-more-things-you-can-do-on-your-website", "1"},
+		{"301", "/blog/a-note-on-essential-complexity", "1"},
+		{"200", "/", "1"},
+		{"200", "/blog/deconstructing-the-role-playing-videogame/", "1"},
+	})
+
+	_, rows = runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"query", "status", "url", "--per", "status", "-l", "1"})
+	assertEqual(t, rows, [][]string{{"301", "/feed", "2"}, {"200", "/feed.xml", "3"}})
+	_, rows = runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"query", "status", "url", "--per", "status", "-l", "1", "--groups", "1"})
+	assertEqual(t, rows, [][]string{{"301", "/feed", "2"}})
+	_, rows = runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"query", "status", "url", "--per", "status", "-l", "1", "--offset", "1"})
+	assertEqual(t, rows, [][]string{{"200", "/feed.xml", "3"}})
+	_, rows = runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"query", "status", "url", "--per", "status", "-l", "1", "--sort", "status", "--asc"})
+	assertEqual(t, rows, [][]string{{"200", "/feed.xml", "3"}, {"301", "/feed", "2"}})
+
+	os.Args = []string{"ngtop", "url", "--per", "status"}
+	_, cli := parseCLI()
+	_, err := cli.Query.querySpec(time.UTC)
+	assertEqual(t, err.Error(), "can't group by status, it's not one of the query fields")
+	os.Args = []string{"ngtop", "url", "--per", "url"}
+	_, cli = parseCLI()
+	_, err = cli.Query.querySpec(time.UTC)
+	assertEqual(t, err.Error(), "--per needs at least one other query field to get the top results of each group")
+}
+
+func TestPivot(t *testing.T) {
+	columns, rows := runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"query", "status", "url", "--pivot", "status", "-l", "3"})
+	// pivot values are sorted by their total requests, followed by the row total
+	assertEqual(t, columns, []string{"path", "301", "200", "#reqs"})
+	assertEqual(t, rows, [][]string{
+		{"/feed.xml", "0", "3", "3"},
+		{"/feed", "2", "0", "2"},
+		{"/", "0", "1", "1"},
+	})
+
+	columns, rows = runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"method", "user", "url", "--pivot", "url", "--pivot-columns", "2"})
+	assertEqual(t, columns, []string{"method", "user", "/feed.xml", "/feed", "(other)", "#reqs"})
+	assertEqual(t, rows, [][]string{
+		{"GET", "", "1", "2", "6", "9"},
+		{"GET", "facundo", "2", "0", "0", "2"},
+	})
+
+	// the thresholds and sorting apply to the rows
+	_, rows = runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"url", "user", "--pivot", "user", "--min-count", "2", "--sort", "url", "--asc"})
+	assertEqual(t, rows, [][]string{{"/feed", "2", "0", "2"}, {"/feed.xml", "1", "2", "3"}})
+
+	os.Args = []string{"ngtop", "url", "--pivot", "url"}
+	_, cli := parseCLI()
+	_, err := cli.Query.querySpec(time.UTC)
+	assertEqual(t, err.Error(), "--pivot needs at least one other query field to group the rows")
+	os.Args = []string{"ngtop", "url", "--pivot", "method"}
+	_, cli = parseCLI()
+	_, err = cli.Query.querySpec(time.UTC)
+	assertEqual(t, err.Error(), "can't pivot by method, it's not one of the query fields")
+}
+
+func TestSparkline(t *testing.T) {
+	assertEqual(t, sparkline([]int{0, 1, 2, 3, 4, 5, 6, 7, 0}), "▁▂▃▄▅▆▇█▁")
+	assertEqual(t, sparkline([]int{0, 1, 100, 50}), "▁▂█▅")
+	assertEqual(t, sparkline([]int{0, 0, 0}), "▁▁▁")
+}
+
+func TestCharts(t *testing.T) {
+	assertEqual(t, bar(3, 3, 10), "██████████")
+	assertEqual(t, bar(1, 3, 10), "███▎")
+	assertEqual(t, bar(0, 3, 10), "")
+
+	// time series cover the window, or the results if it's unbounded
+	utc := time.UTC
+	since := time.Date(2024, time.July, 30, 0, 0, 0, 0, utc)
+	until := time.Date(2024, time.August, 2, 0, 0, 0, 0, utc)
+	assertEqual(t, timeSeries("date", map[string]int{"2024-07-31": 1}, since, until, utc), []string{"2024-07-30", "2024-07-31", "2024-08-01"})
+	assertEqual(t, timeSeries("month", map[string]int{"2024-05": 1, "2024-07": 2}, time.Time{}, time.Time{}, utc), []string{"2024-05", "2024-06", "2024-07"})
+	assertEqual(t, len(timeSeries("hour", nil, since, until, utc)), 24)
+
+	var output strings.Builder
+	printLineChart(&output, []string{"a", "b"}, map[string]int{"b": 4}, 14)
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	assertEqual(t, len(lines), CHART_HEIGHT+2)
+	// a line from the bottom left to the top right corner
+	top, bottom := []rune(lines[0]), []rune(lines[CHART_HEIGHT-1])
+	assertEqual(t, string(top[:3]), "4 ┤")
+	assert(t, top[len(top)-1]&0x08 != 0)
+	assertEqual(t, string(bottom[:3]), "  │")
+	assert(t, bottom[3]&0x40 != 0)
+	assertEqual(t, lines[CHART_HEIGHT], "0 └───────────")
+	assertEqual(t, lines[CHART_HEIGHT+1], "   a         b")
+}
+
+func TestShares(t *testing.T) {
+	columns, rows := runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"url", "-l", "2", "--percent", "--cumulative", "--other"})
+	assertEqual(t, columns, []string{"path", "#reqs", "%", "cum%"})
+	assertEqual(t, rows, [][]string{
+		{"/feed.xml", "3", "27.3%", "27.3%"},
+		{"/feed", "2", "18.2%", "45.5%"},
+		{"(other)", "6", "54.5%", "100.0%"},
+	})
+
+	// the total is that of the filtered window
+	columns, rows = runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"url", "method", "-l", "1", "-w", "status=200", "--percent", "--other"})
+	assertEqual(t, columns, []string{"path", "method", "#reqs", "%"})
+	assertEqual(t, rows, [][]string{{"/feed.xml", "GET", "3", "60.0%"}, {"(other)", "", "2", "40.0%"}})
+
+	// no other row when all the results are included
+	_, rows = runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"method", "--other", "--cumulative"})
+	assertEqual(t, rows, [][]string{{"GET", "11", "100.0%"}})
+
+	// the results skipped by the offset and the thresholds can't be told apart from the other ones
+	os.Args = []string{"ngtop", "url", "--offset", "1", "--other"}
+	_, cli := parseCLI()
+	_, err := cli.Query.querySpec(time.UTC)
+	assertEqual(t, err.Error(), "--other and --cumulative can't be combined with --offset, --min-count or --max-count")
+	os.Args = []string{"ngtop", "url", "--max-count", "2", "--cumulative"}
+	_, cli = parseCLI()
+	_, err = cli.Query.querySpec(time.UTC)
+	assert(t, err != nil)
+
+	// the percentages of each result don't depend on the rest
+	_, rows = runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"url", "--offset", "1", "--min-count", "2", "--percent"})
+	assertEqual(t, rows, [][]string{{"/feed", "2", "18.2%"}})
+}
+
+func TestCountThresholds(t *testing.T) {
+	_, rows := runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"url", "--min-count", "2"})
+	assertEqual(t, rows, [][]string{{"/feed.xml", "3"}, {"/feed", "2"}})
+	_, rows = runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"url", "--max-count", "2", "-l", "10"})
+	assertEqual(t, len(rows), 7)
+	assertEqual(t, rows[0], []string{"/feed", "2"})
+	_, rows = runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"url", "--min-count", "2", "--max-count", "2"})
+	assertEqual(t, rows, [][]string{{"/feed", "2"}})
+	_, rows = runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"ua", "--min-count", "4"})
+	assertEqual(t, len(rows), 0)
+}
+
 func TestMultiField(t *testing.T) {
 	columns, rows := runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"url", "method"})
 	assertEqual(t, columns, []string{"path", "method", "#reqs"})
@@ -174,7 +408,8 @@ func TestMultiField(t *testing.T) {
 	assertEqual(t, rows[0], []string{"GET", "301", "6"})
 	assertEqual(t, rows[1], []string{"GET", "200", "5"})
 
-	columns, rows = runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"status", "method"})
+	// status is also a command name, so the query command needs to be explicit
+	columns, rows = runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"query", "status", "method"})
 	assertEqual(t, columns, []string{"status", "method", "#reqs"})
 	assertEqual(t, len(rows), 2)
 	assertEqual(t, rows[0], []string{"301", "GET", "6"})
@@ -250,6 +485,34 @@ func TestWhereNegation(t *testing.T) {
 	assertEqual(t, len(rows), 5)
 }
 
+func TestTimeFields(t *testing.T) {
+	columns, rows := runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"hour", "weekday"})
+	assertEqual(t, columns, []string{"hour", "weekday", "#reqs"})
+	assertEqual(t, rows, [][]string{{"0", "wed", "11"}})
+
+	_, rows = runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"date", "-w", "dow=sat"})
+	assertEqual(t, len(rows), 0)
+}
+
+func TestHeatmap(t *testing.T) {
+	var output strings.Builder
+	printHeatmap(&output, [][]string{{"wed", "0", "8"}, {"wed", "1", "2"}, {"sat", "23", "5"}, {"sun", "9", "1200"}}, false)
+	lines := strings.Split(output.String(), "\n")
+	assertEqual(t, len(lines), 11)
+	assertEqual(t, lines[0], "    00 01 02 03 04 05 06 07 08 09 10 11 12 13 14 15 16 17 18 19 20 21 22 23  #REQS")
+	assertEqual(t, lines[1], "MON "+strings.Repeat("   ", 23)+"    0")
+	assertEqual(t, lines[3], "WED ░░ ░░"+strings.Repeat("   ", 22)+"  10")
+	assertEqual(t, lines[6], "SAT "+strings.Repeat("   ", 23)+"░░  5")
+	assertEqual(t, lines[7], "SUN "+strings.Repeat("   ", 9)+"██"+strings.Repeat("   ", 14)+"  1.2K")
+	assertEqual(t, lines[9], "░░ ≤300  ▒▒ ≤600  ▓▓ ≤900  ██ ≤1.2K")
+
+	// with the same filters as the query command
+	_, rows := runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"weekday", "hour", "-w", "status=200", "-l", "168"})
+	output.Reset()
+	printHeatmap(&output, rows, false)
+	assertEqual(t, strings.Split(output.String(), "\n")[3], "WED ██"+strings.Repeat("   ", 23)+"  5")
+}
+
 func TestCustomFormat(t *testing.T) {
 	format := `$remote_addr [$time_iso8601] $server_name $document_root $host $uri $content_type`
 	sample := `xx.xx.xx.xx [2024-07-24T00:00:49+00:00] jorge.olano.dev /var/www/jorge jorge.olano.dev /index.html -
@@ -268,6 +531,59 @@ xx.xx.xx.xx [2024-07-24T00:00:51+00:00] jorge.olano.dev /var/www/jorge jorge.ola
 	assertEqual(t, rows[0][0], "jorge.olano.dev")
 }
 
+func TestDynamicFields(t *testing.T) {
+	format := `$remote_addr [$time_iso8601] $scheme "$http_x_forwarded_for" $uri $upstream_addr`
+	sample := `xx.xx.xx.xx [2024-07-24T00:00:49+00:00] https "203.0.113.5, 10.0.0.1" /index.html 127.0.0.1:8000
+xx.xx.xx.xx [2024-07-24T00:00:50+00:00] https "-" /index.html 127.0.0.1:8001
+xx.xx.xx.xx [2024-07-24T00:00:51+00:00] http "203.0.113.5, 10.0.0.1" /assets/css/main.css 127.0.0.1:8000`
+
+	columns, rows := runCommand(t, format, sample, []string{"scheme"})
+	assertEqual(t, columns, []string{"scheme", "#reqs"})
+	assertEqual(t, rows, [][]string{{"https", "2"}, {"http", "1"}})
+
+	columns, rows = runCommand(t, format, sample, []string{"upstream_addr", "-w", "http_x_forwarded_for=203.0.113.5%"})
+	assertEqual(t, columns, []string{"upstream_addr", "#reqs"})
+	assertEqual(t, rows, [][]string{{"127.0.0.1:8000", "2"}})
+
+	// the default format also includes a variable that isn't a known field
+	_, rows = runCommand(t, DEFAULT_LOG_FORMAT, SAMPLE_LOGS, []string{"body_bytes_sent", "-l", "1"})
+	assertEqual(t, rows, [][]string{{"169", "6"}})
+}
+
+func TestFormatChange(t *testing.T) {
+	dbFile, err := os.CreateTemp("", "ngtop.db")
+	assertEqual(t, err, nil)
+	defer os.Remove(dbFile.Name())
+
+	// create the db with a format, then open it again with one that adds a new variable
+	parser := ngtop.NewParser(`$remote_addr [$time_iso8601] $uri`)
+	dbs, err := ngtop.InitDB(dbFile.Name(), parser.Fields)
+	assertEqual(t, err, nil)
+	dbs.Close()
+
+	parser = ngtop.NewParser(`$remote_addr [$time_iso8601] $uri $ssl_protocol`)
+	dbs, err = ngtop.InitDB(dbFile.Name(), parser.Fields)
+	assertEqual(t, err, nil)
+	defer dbs.Close()
+
+	logFile, err := os.CreateTemp("", "access.log")
+	assertEqual(t, err, nil)
+	defer os.Remove(logFile.Name())
+	_, err = logFile.Write([]byte(`xx.xx.xx.xx [2024-07-24T00:00:49+00:00] /index.html TLSv1.3`))
+	assertEqual(t, err, nil)
+
+	err = loadLogs(context.Background(), parser, logFile.Name(), dbs)
+	assertEqual(t, err, nil)
+
+	os.Args = []string{"ngtop", "ssl_protocol"}
+	_, cli := parseCLI()
+	spec, err := cli.Query.querySpec(time.UTC)
+	assertEqual(t, err, nil)
+	_, rows, err := dbs.QueryTop(context.Background(), spec)
+	assertEqual(t, err, nil)
+	assertEqual(t, rows, [][]string{{"TLSv1.3", "1"}})
+}
+
 func TestMismatchedLine(t *testing.T) {
 	sample := `xx.xx.xx.xx - - [24/Jul/2024:00:00:28 +0000] "GET /feed HTTP/1.1" 301 169 "-" "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/109.0.0.0 Safari/537.36"
 this has a different format
@@ -297,16 +613,18 @@ func TestUpdatedLog(t *testing.T) {
 	defer dbs.Close()
 
 	os.Args = []string{"ngtop"}
-	_, spec := querySpecFromCLI()
+	_, cli := parseCLI()
+	spec, err := cli.Query.querySpec(time.UTC)
+	assertEqual(t, err, nil)
 
 	bytesWritten, err := logFile.Write([]byte(`xx.xx.xx.xx - - [24/Jul/2024:00:00:28 +0000] "GET /feed HTTP/1.1" 301 169 "-" "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/109.0.0.0 Safari/537.36"
 xx.xx.xx.xx - - [24/Jul/2024:00:00:30 +0000] "GET /feed HTTP/1.1" 301 169 "-" "feedi/0.1.0 (+https://github.com/facundoolano/feedi)"`))
 	assertEqual(t, err, nil)
 	previousOffset := bytesWritten
 
-	err = loadLogs(parser, logFile.Name(), dbs)
+	err = loadLogs(context.Background(), parser, logFile.Name(), dbs)
 	assertEqual(t, err, nil)
-	_, rows, err := dbs.QueryTop(spec)
+	_, rows, err := dbs.QueryTop(context.Background(), spec)
 	assertEqual(t, err, nil)
 	assertEqual(t, rows[0][0], "2")
 
@@ -318,16 +636,16 @@ xx.xx.xx.xx - - [24/Jul/2024:00:01:18 +0000] "GET /feed.xml HTTP/1.1" 200 9641 "
 	previousOffset += bytesWritten
 
 	// run again with more entries and expect to see new requests
-	err = loadLogs(parser, logFile.Name(), dbs)
+	err = loadLogs(context.Background(), parser, logFile.Name(), dbs)
 	assertEqual(t, err, nil)
-	_, rows, err = dbs.QueryTop(spec)
+	_, rows, err = dbs.QueryTop(context.Background(), spec)
 	assertEqual(t, err, nil)
 	assertEqual(t, rows[0][0], "4")
 
 	// run again without more entries, count should be the same
-	err = loadLogs(parser, logFile.Name(), dbs)
+	err = loadLogs(context.Background(), parser, logFile.Name(), dbs)
 	assertEqual(t, err, nil)
-	_, rows, err = dbs.QueryTop(spec)
+	_, rows, err = dbs.QueryTop(context.Background(), spec)
 	assertEqual(t, err, nil)
 	assertEqual(t, rows[0][0], "4")
 
@@ -337,15 +655,269 @@ xx.xx.xx.xx - - [24/Jul/2024:00:01:18 +0000] "GET /blog/deconstructing-the-role-
 	assertEqual(t, err, nil)
 
 	// check that the new request is added even though it has the same date as the cut out one
-	err = loadLogs(parser, logFile.Name(), dbs)
+	err = loadLogs(context.Background(), parser, logFile.Name(), dbs)
 	assertEqual(t, err, nil)
-	_, rows, err = dbs.QueryTop(spec)
+	_, rows, err = dbs.QueryTop(context.Background(), spec)
 	assertEqual(t, err, nil)
 	assertEqual(t, rows[0][0], "5")
 }
 
+func TestLogs(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "access.log")
+	err := os.WriteFile(logPath, []byte(SAMPLE_LOGS), 0644)
+	assertEqual(t, err, nil)
+	env := []string{"NGTOP_DB=" + filepath.Join(dir, "ngtop.db"), "NGTOP_LOGS_PATH=" + logPath}
+
+	// the most recent entries, in time order
+	output, err := runMain(t, env, "--tz", "UTC", "logs", "-w", "status=301", "-l", "2")
+	assertEqual(t, err, nil)
+	assertEqual(t, strings.Split(output, "\n"), []string{
+		"TIME                IP          METHOD PATH                                 STATUS USER_AGENT",
+		"2024-07-24 00:06:41 xx.xx.xx.xx GET    /blog/a-note-on-essential-complexity 301    Safari",
+		"2024-07-24 00:06:41 xx.xx.xx.xx GET    /blog/posdata-de-borges-y-bioy       301    Safari",
+		"",
+	})
+
+	output, err = runMain(t, env, "--tz", "UTC", "logs", "user", "hour", "-s", "2024-07-24 00:01", "-u", "2024-07-24 00:02", "--no-update")
+	assertEqual(t, err, nil)
+	assertEqual(t, output, "TIME                USER    HOUR\n2024-07-24 00:01:18         0\n2024-07-24 00:01:20 facundo 0\n2024-07-24 00:01:51 facundo 0\n")
+
+	// when following, entries already printed at the last time are skipped
+	var cursor logsCursor
+	rows := cursor.advance([][]string{{"00:01", "a"}, {"00:02", "b"}})
+	assertEqual(t, rows, [][]string{{"00:01", "a"}, {"00:02", "b"}})
+	rows = cursor.advance([][]string{{"00:02", "b"}, {"00:02", "c"}, {"00:03", "d"}})
+	assertEqual(t, rows, [][]string{{"00:02", "c"}, {"00:03", "d"}})
+	rows = cursor.advance([][]string{{"00:03", "d"}})
+	assertEqual(t, len(rows), 0)
+}
+
+func TestExplain(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "access.log")
+	err := os.WriteFile(logPath, []byte(SAMPLE_LOGS), 0644)
+	assertEqual(t, err, nil)
+	env := []string{"NGTOP_DB=" + filepath.Join(dir, "ngtop.db"), "NGTOP_LOGS_PATH=" + logPath}
+
+	output, err := runMain(t, env, "url", "-w", "ua=Safari", "--explain")
+	assertEqual(t, err, nil)
+	sections := strings.Split(output, "\n\n")
+	assertEqual(t, len(sections), 3)
+	assert(t, strings.HasPrefix(sections[0], "SELECT (SELECT value FROM dict_path WHERE id = access_logs.path) path"))
+	assertEqual(t, sections[1], "args: '2024-07-23 23:07:00+00:00', '2024-07-24 00:07:00+00:00', 'Safari'")
+	assert(t, strings.HasPrefix(sections[2], "QUERY PLAN\n|--SEARCH access_logs USING INDEX access_logs_user_agent (user_agent=?)\n"))
+
+	output, err = runMain(t, env, "logs", "--explain")
+	assertEqual(t, err, nil)
+	assert(t, strings.Contains(output, "QUERY PLAN\n"))
+
+	// the logs weren't loaded
+	output, err = runMain(t, env, "--no-update")
+	assertEqual(t, err, nil)
+	assertEqual(t, output, "#REQS\n0\n")
+}
+
+func TestFields(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "access.log")
+	err := os.WriteFile(logPath, []byte(`xx.xx.xx.xx [2024-07-24T00:00:49+00:00] /index.html -
+yy.yy.yy.yy [2024-07-24T00:00:50+00:00] /index.html https
+xx.xx.xx.xx [2024-07-24T00:00:51+00:00] /assets/css/main.css https`), 0644)
+	assertEqual(t, err, nil)
+	env := []string{
+		"NGTOP_DB=" + filepath.Join(dir, "ngtop.db"),
+		"NGTOP_LOGS_PATH=" + logPath,
+		"NGTOP_LOG_FORMAT=$remote_addr [$time_iso8601] $uri $scheme",
+	}
+
+	// fields missing from the format are rejected before querying
+	_, err = runMain(t, env, "url", "-w", "ua=Firefox")
+	assert(t, err != nil)
+	_, err = runMain(t, env, "logs", "referer")
+	assert(t, err != nil)
+
+	_, err = runMain(t, env, "ingest")
+	assertEqual(t, err, nil)
+	output, err := runMain(t, env, "fields", "--tz", "UTC")
+	assertEqual(t, err, nil)
+	assertEqual(t, strings.Split(output, "\n"), []string{
+		"FIELD   ALIASES      SOURCE        TYPE               FILLED DISTINCT",
+		"time                 $time_iso8601 TIMESTAMP NOT NULL 100.0% 3",
+		"ip      ip           $remote_addr  TEXT               100.0% 2",
+		"path    path,url,uri $uri          TEXT               100.0% 2",
+		"hour    hour         time          virtual            100.0% 1",
+		"weekday weekday,dow  time          virtual            100.0% 1",
+		"date    date,day     time          virtual            100.0% 1",
+		"month   month        time          virtual            100.0% 1",
+		"scheme  scheme       $scheme       TEXT               66.7%  1",
+		"",
+	})
+
+	// fields stored by an earlier log format can still be queried
+	env[2] = "NGTOP_LOG_FORMAT=[$time_iso8601] $uri $scheme \"$http_referer\""
+	output, err = runMain(t, env, "ip", "-s", "all", "--no-update")
+	assertEqual(t, err, nil)
+	assertEqual(t, output, "IP          #REQS\nxx.xx.xx.xx 2\nyy.yy.yy.yy 1\n")
+	output, err = runMain(t, env, "ip", "-s", "all", "--offline")
+	assertEqual(t, err, nil)
+	assertEqual(t, output, "IP          #REQS\nxx.xx.xx.xx 2\nyy.yy.yy.yy 1\n")
+	_, err = runMain(t, env, "url", "-w", "ua=Firefox", "--offline")
+	assert(t, err != nil)
+
+	// the entries stored before a field was added to the format don't have values of it
+	output, err = runMain(t, env, "fields")
+	assertEqual(t, err, nil)
+	assertEqual(t, strings.Split(output, "\n")[2], "referer referer,ref,referrer $http_referer TEXT COLLATE NOCASE 0.0%   0")
+}
+
+func TestConcurrentProcesses(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "ngtop.db")
+	logPath := filepath.Join(dir, "access.log")
+
+	// a log big enough for the processes loading it to overlap
+	var logs strings.Builder
+	start := time.Date(2024, time.July, 23, 12, 0, 0, 0, time.UTC)
+	for i := range 20000 {
+		timestamp := start.Add(time.Duration(i) * time.Second).Format("02/Jan/2006:15:04:05 -0700")
+		fmt.Fprintf(&logs, "xx.xx.xx.xx - - [%s] \"GET /blog/%d HTTP/1.1\" 200 1120 \"-\" \"FreshRSS/1.24.0 (Linux; https://freshrss.org)\"\n", timestamp, i%10)
+	}
+	err := os.WriteFile(logPath, []byte(logs.String()), 0644)
+	assertEqual(t, err, nil)
+
+	// run processes that load the logs and processes that only query the db at the same time,
+	// using the test binary, which runs main when NGTOP_TEST_RUN_MAIN is set
+	executable, err := os.Executable()
+	assertEqual(t, err, nil)
+	var commands []*exec.Cmd
+	var outputs []*bytes.Buffer
+	for i := range 8 {
+		logsPath := logPath
+		if i%2 == 1 {
+			logsPath = filepath.Join(dir, "missing.log")
+		}
+		output := new(bytes.Buffer)
+		cmd := exec.Command(executable, "path", "-s", "1d")
+		cmd.Env = append(os.Environ(), "NGTOP_TEST_RUN_MAIN=1", "NGTOP_DB="+dbPath, "NGTOP_LOGS_PATH="+logsPath)
+		cmd.Stdout = output
+		cmd.Stderr = output
+		err := cmd.Start()
+		assertEqual(t, err, nil)
+		commands = append(commands, cmd)
+		outputs = append(outputs, output)
+	}
+	for i, cmd := range commands {
+		if err := cmd.Wait(); err != nil {
+			t.Fatalf("process %d failed: %s\n%s", i, err, outputs[i])
+		}
+	}
+
+	// each entry is stored exactly once
+	parser := ngtop.NewParser(DEFAULT_LOG_FORMAT)
+	dbs, err := ngtop.InitDB(dbPath, parser.Fields)
+	assertEqual(t, err, nil)
+	defer dbs.Close()
+	_, rows, err := dbs.QueryTop(context.Background(), &ngtop.RequestCountSpec{TimeSince: start.Add(-time.Hour), TimeUntil: NowTimeFun(), Limit: 5})
+	assertEqual(t, err, nil)
+	assertEqual(t, rows, [][]string{{"20000"}})
+}
+
+func TestSeparateIngest(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "ngtop.db")
+	logPath := filepath.Join(dir, "access.log")
+	err := os.WriteFile(logPath, []byte(SAMPLE_LOGS+"\nthis has a different format"), 0644)
+	assertEqual(t, err, nil)
+	env := []string{"NGTOP_DB=" + dbPath, "NGTOP_LOGS_PATH=" + logPath}
+
+	// the db can't be opened read-only before it's created
+	_, err = runMain(t, env, "--offline")
+	assert(t, err != nil)
+
+	output, err := runMain(t, env, "ingest")
+	assertEqual(t, err, nil)
+	assertEqual(t, output, "")
+
+	// once ingested, the logs aren't needed to query
+	env = []string{"NGTOP_DB=" + dbPath, "NGTOP_LOGS_PATH=" + filepath.Join(dir, "missing.log")}
+	output, err = runMain(t, env, "--offline")
+	assertEqual(t, err, nil)
+	assertEqual(t, output, "#REQS\n11\n")
+	output, err = runMain(t, env, "query", "status", "--no-update")
+	assertEqual(t, err, nil)
+	assertEqual(t, output, "STATUS #REQS\n301    6\n200    5\n")
+
+	output, err = runMain(t, env, "status")
+	assertEqual(t, err, nil)
+	lines := strings.Split(output, "\n")
+	assertEqual(t, lines[0], "db:             "+dbPath)
+	assert(t, strings.HasPrefix(lines[1], "db size:        "))
+	assertEqual(t, lines[2:], []string{
+		"log entries:    11",
+		"first entry:    2024-07-24 00:00:28",
+		"last entry:     2024-07-24 00:06:41",
+		"last ingestion: 2024-07-24 00:07:00",
+		"",
+		"FILE" + strings.Repeat(" ", len(logPath)-3) + "LINES NEW ENTRIES SKIPPED",
+		logPath + " 12    11          1",
+		"",
+		"skipped lines in " + logPath + ":",
+		"  this has a different format",
+		"",
+	})
+
+	// loading the same file again doesn't duplicate the rejected line
+	_, err = runMain(t, []string{"NGTOP_DB=" + dbPath, "NGTOP_LOGS_PATH=" + logPath}, "ingest")
+	assertEqual(t, err, nil)
+	output, err = runMain(t, env, "rejects")
+	assertEqual(t, err, nil)
+	assertEqual(t, strings.Split(output, "\n")[1], "line didn't match the log format 1      2024-07-24 00:07:00 "+logPath+":12 this has a different format")
+
+	output, err = runMain(t, env, "sql", "SELECT count(DISTINCT ip) ips, max(status) FROM access_logs")
+	assertEqual(t, err, nil)
+	assertEqual(t, output, "IPS MAX(STATUS)\n1   301\n")
+	output, err = runMain(t, env, "sql", "SELECT path, count(1) FROM v_requests WHERE user = 'facundo' GROUP BY path")
+	assertEqual(t, err, nil)
+	assertEqual(t, output, "PATH      COUNT(1)\n/feed.xml 2\n")
+
+	// the sql command can't modify the db
+	_, err = runMain(t, env, "sql", "DELETE FROM access_logs")
+	assert(t, err != nil)
+	output, err = runMain(t, env, "--offline")
+	assertEqual(t, err, nil)
+	assertEqual(t, output, "#REQS\n11\n")
+}
+
+func TestStatusHint(t *testing.T) {
+	assertEqual(t, statusHint([]string{"status"}), "")
+	assertEqual(t, statusHint([]string{"status", "--help"}), "")
+	assertEqual(t, statusHint([]string{"query", "status", "-w", "status=404"}), "")
+	assertEqual(t, statusHint([]string{"status", "-w", "status=404"}), "hint: the status command prints a summary of the DB, to count requests by status run `ngtop query status -w status=404`")
+	assertEqual(t, statusHint([]string{"--tz", "UTC", "status", "url"}), "hint: the status command prints a summary of the DB, to count requests by status run `ngtop query status url`")
+}
+
+func TestEscapeLine(t *testing.T) {
+	assertEqual(t, escapeLine("GET /feed HTTP/1.1"), "GET /feed HTTP/1.1")
+	assertEqual(t, escapeLine("GET /\x1b[2J HTTP/1.1"), `GET /\x1b[2J HTTP/1.1`)
+	assertEqual(t, escapeLine("café\t\"x\""), `caf\u00e9\t\"x\"`)
+}
+
 // ------ HELPERS --------
 
+// Run the program in a separate process with the given environment variables and arguments,
+// returning its standard output.
+func runMain(t *testing.T, env []string, args ...string) (string, error) {
+	executable, err := os.Executable()
+	assertEqual(t, err, nil)
+	cmd := exec.Command(executable, args...)
+	cmd.Env = append(append(os.Environ(), "NGTOP_TEST_RUN_MAIN=1"), env...)
+	output := new(bytes.Buffer)
+	cmd.Stdout = output
+	err = cmd.Run()
+	return output.String(), err
+}
+
 func runCommand(t *testing.T, format string, logs string, cliArgs []string) ([]string, [][]string) {
 	// write the logs to a temp file, and point the NGTOP_LOGS_PATH env to it
 	logFile, err := os.CreateTemp("", "access.log")
@@ -359,17 +931,20 @@ func runCommand(t *testing.T, format string, logs string, cliArgs []string) ([]s
 	assertEqual(t, err, nil)
 	defer os.Remove(dbFile.Name())
 
+	parser := ngtop.NewParser(format)
+
 	os.Args = append([]string{"ngtop"}, cliArgs...)
-	_, spec := querySpecFromCLI()
+	_, cli := parseCLI()
+	spec, err := cli.Query.querySpec(time.UTC)
+	assertEqual(t, err, nil)
 
-	parser := ngtop.NewParser(format)
 	dbs, err := ngtop.InitDB(dbFile.Name(), parser.Fields)
 	assertEqual(t, err, nil)
 	defer dbs.Close()
 
-	err = loadLogs(parser, logFile.Name(), dbs)
+	err = loadLogs(context.Background(), parser, logFile.Name(), dbs)
 	assertEqual(t, err, nil)
-	columnNames, rowValues, err := dbs.QueryTop(spec)
+	columnNames, rowValues, err := dbs.QueryTop(context.Background(), spec)
 	assertEqual(t, err, nil)
 	return columnNames, rowValues
 }
@@ -381,6 +956,12 @@ func TestMain(m *testing.M) {
 		return time.Date(2024, time.July, 24, 0, 7, 0, 0, time.UTC)
 	}
 
+	// run the program instead of the tests, for tests that need to spawn ngtop processes
+	if os.Getenv("NGTOP_TEST_RUN_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+
 	m.Run()
 }
 
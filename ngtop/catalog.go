@@ -0,0 +1,116 @@
+package ngtop
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The coverage of a field in the stored log entries.
+type FieldStats struct {
+	// the amount of entries with a non empty value of the field
+	Populated int64
+	// the amount of distinct non empty values
+	Distinct int64
+}
+
+// Returns the fields that can be queried for logs in the parser format: the ones of its variables,
+// the ones derived from them and the virtual fields computed from the log time.
+// Known fields come first, in the order of KNOWN_FIELDS, followed by the dynamic ones sorted by name.
+func (parser LogParser) AvailableFields() []*LogField {
+	var fields []*LogField
+	seen := make(map[string]bool)
+	for i := range KNOWN_FIELDS {
+		field := &KNOWN_FIELDS[i]
+		if seen[field.ColumnName] {
+			continue
+		}
+		if field.Expression != "" || parser.hasField(field.ColumnName) {
+			seen[field.ColumnName] = true
+			fields = append(fields, COLUMN_NAME_TO_FIELD[field.ColumnName])
+		}
+	}
+
+	var dynamic []*LogField
+	for _, field := range parser.Fields {
+		if !seen[field.ColumnName] {
+			dynamic = append(dynamic, field)
+		}
+	}
+	slices.SortFunc(dynamic, func(a *LogField, b *LogField) int {
+		return strings.Compare(a.ColumnName, b.ColumnName)
+	})
+	return append(fields, dynamic...)
+}
+
+// Returns the sources of the given column in the parser format, see ColumnSources.
+func (parser LogParser) FieldSources(column string) []string {
+	var sources []string
+	for _, source := range ColumnSources(column) {
+		if source == "time" || slices.ContainsFunc(parser.Fields, func(field *LogField) bool {
+			return field.LogFormatVar != "" && "$"+field.LogFormatVar == source
+		}) {
+			sources = append(sources, source)
+		}
+	}
+	return sources
+}
+
+func (parser LogParser) hasField(column string) bool {
+	return slices.ContainsFunc(parser.Fields, func(field *LogField) bool { return field.ColumnName == column })
+}
+
+// Returns true if the given field can be queried in the DB: it has a column in the access_logs table,
+// e.g. from the current or an earlier log format, or it's a virtual field computed from the log time.
+func (dbs *DBSession) HasField(column string) bool {
+	if field, found := COLUMN_NAME_TO_FIELD[column]; found && field.Expression != "" {
+		return true
+	}
+	return dbs.tableColumns[column]
+}
+
+// Returns the amount of stored log entries, and how many of them have a value of each of the given fields.
+// Fields without a column in the access_logs table are left out of the results.
+// The values of virtual fields are computed with times in the given location.
+func (dbs *DBSession) FieldStats(ctx context.Context, columns []string, location *time.Location) (int64, map[string]*FieldStats, error) {
+	expressions := []string{"count(1)"}
+	var queryArgs []any
+	var queried []string
+	for _, column := range columns {
+		expression := columnExpression(column, location)
+		condition := expression + " IS NOT NULL"
+		if expression == column {
+			if !dbs.tableColumns[column] {
+				continue
+			}
+			// empty values are usually stored as such, but entries inserted before the column was added have nulls
+			condition = column + " IS NOT NULL AND " + dbs.dictionaries.condition(column, "=", true)
+			queryArgs = append(queryArgs, "", "")
+		}
+		expressions = append(expressions,
+			fmt.Sprintf("count(1) FILTER (WHERE %s)", condition),
+			fmt.Sprintf("count(DISTINCT %s) FILTER (WHERE %s)", expression, condition),
+		)
+		queried = append(queried, column)
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM access_logs", strings.Join(expressions, ", "))
+	log.Printf("query: %s\n", query)
+	_, rows, err := dbs.queryStrings(ctx, query, queryArgs...)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	total, _ := strconv.ParseInt(rows[0][0], 10, 64)
+	stats := make(map[string]*FieldStats)
+	for i, column := range queried {
+		populated, _ := strconv.ParseInt(rows[0][1+2*i], 10, 64)
+		distinct, _ := strconv.ParseInt(rows[0][2+2*i], 10, 64)
+		stats[column] = &FieldStats{Populated: populated, Distinct: distinct}
+	}
+	return total, stats, nil
+}
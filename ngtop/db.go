@@ -1,11 +1,14 @@
 package ngtop
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
-	_ "github.com/mattn/go-sqlite3"
 	"log"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -14,116 +17,395 @@ type RequestCountSpec struct {
 	GroupByMetrics []string
 	TimeSince      time.Time
 	TimeUntil      time.Time
-	Limit          int
-	Where          map[string][]string
+	// The timezone of virtual time fields like `hour` or `date`. Defaults to UTC.
+	Location *time.Location
+	Where    map[string][]string
+	// The field to sort the results by, which must be one of GroupByMetrics. Defaults to the request count.
+	SortBy    string
+	Ascending bool
+	Limit     int
+	Offset    int
+	// Fields of GroupByMetrics to split the results into groups, returning the top Limit results of each
+	// of the top GroupLimit groups. The offset applies to the groups.
+	PerMetrics []string
+	GroupLimit int
+	// The last field of GroupByMetrics, whose top PivotLimit values are turned into columns with the request counts
+	// of each row, which is grouped by the rest of the fields. The limit, offset and thresholds apply to the rows.
+	PivotMetric string
+	PivotLimit  int
+	// Only include the results with at least or at most these request counts. Zero means no threshold.
+	MinCount int
+	MaxCount int
+	// Add columns with the share of each result in the total requests of the window, and the running sum of those shares.
+	Percent    bool
+	Cumulative bool
+	// Add a final row with the requests of the results that weren't included, so the rows add up to the window total.
+	Other bool
 }
 
 type DBSession struct {
-	db         *sql.DB
-	columns    []string
-	insertTx   *sql.Tx
-	insertStmt *sql.Stmt
+	db     *sql.DB
+	dbPath string
+	// the columns of the fields in the current log format, in the order they are passed to AddLogEntry
+	columns []string
+	// all the columns in the access_logs table, which may include some from previously used log formats
+	tableColumns map[string]bool
+	// the columns whose values are stored in dictionary tables
+	dictionaries dictionaries
+	insertTx     *sql.Tx
+	insertStmt   *sql.Stmt
+	encoder      *dictionaryEncoder
+	// the oldest time of the entries modified by the current update, to know which rollup buckets need to be refreshed
+	updatedSince string
+	// whether the rollup tables should be refreshed after updates
+	rollups bool
+	// the open lock file, while the update lock is held
+	lockFile *os.File
 }
 
 const DB_DATE_LAYOUT = "2006-01-02 15:04:05-07:00"
 
+// The value of the row, or the pivot column, that adds up the requests of the results that weren't included.
+const OTHER_RESULTS = "(other)"
+
 // Open or create the database at the given path.
+// The database is opened in WAL mode, so queries can run while other processes are writing to it,
+// and writers wait for each other up to a timeout instead of failing immediately.
+// Write transactions take the database write lock as soon as they begin, to avoid deadlocks between writers
+// that started reading the same data.
 func InitDB(dbPath string, fields []*LogField) (*DBSession, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+	db, err := sql.Open(SQLITE_DRIVER, dbPath+"?_journal_mode=WAL&_busy_timeout=10000&_txlock=immediate")
 	if err != nil {
 		return nil, err
 	}
-	_, err = db.Exec("PRAGMA journal_mode=memory;")
-	if err != nil {
+
+	if err := migrate(db); err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	// TODO consider adding indexes according to expected queries
+	// the table may have been created with a different log format, add the columns of fields not seen before
+	tableColumns, err := syncColumns(db, fields)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	dictionaries, err := loadDictionaries(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := syncViews(db, dictionaries); err != nil {
+		db.Close()
+		return nil, err
+	}
 
-	var columnSpecs string
 	columns := make([]string, len(fields))
 	for i, field := range fields {
 		columns[i] = field.ColumnName
-		columnSpecs += fmt.Sprintf("%s %s,\n", field.ColumnName, field.ColumnSpec)
 	}
+	return &DBSession{db: db, dbPath: dbPath, columns: columns, tableColumns: tableColumns, dictionaries: dictionaries}, nil
+}
 
-	sqlStmt := fmt.Sprintf(`
-		CREATE TABLE IF NOT EXISTS access_logs (
-			id 				INTEGER NOT NULL PRIMARY KEY,
-			%s
-			created TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		);`, columnSpecs)
+// Open an existing database in read-only mode, e.g. to query a copy of it without access to the logs.
+// The database schema needs to be up to date, since it can't be migrated.
+// Read-only sessions can't insert log entries.
+func OpenReadOnly(dbPath string) (*DBSession, error) {
+	db, err := sql.Open(SQLITE_READONLY_DRIVER, "file:"+dbPath+"?mode=ro&_busy_timeout=10000")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSchemaVersion(db); err != nil {
+		db.Close()
+		return nil, err
+	}
 
-	_, err = db.Exec(sqlStmt)
-	return &DBSession{db: db, columns: columns}, err
+	tableColumns, err := tableColumns(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	dictionaries, err := loadDictionaries(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &DBSession{db: db, dbPath: dbPath, tableColumns: tableColumns, dictionaries: dictionaries}, nil
+}
+
+// Keep the hourly and daily rollup tables up to date when log entries are inserted, so queries
+// over long time windows can read pre-aggregated counts instead of scanning every entry.
+func (dbs *DBSession) EnableRollups() {
+	dbs.rollups = true
 }
 
 func (dbs *DBSession) Close() {
+	dbs.UnlockUpdates()
 	dbs.db.Close()
 }
 
-// Prepare a transaction to insert a new batch of log entries, returning the time of the last seen log entry.
-func (dbs *DBSession) PrepareForUpdate() (*time.Time, error) {
+// Acquire the advisory lock that prevents other processes from updating the database at the same time.
+// Returns false without waiting if `wait` is false and the lock is held by another process.
+// Callers loading new log entries should hold this lock from before PrepareForUpdate or PrepareForInsert
+// until after FinishUpdate.
+func (dbs *DBSession) LockUpdates(wait bool) (bool, error) {
+	if dbs.lockFile != nil {
+		return true, nil
+	}
+	file, err := lockDB(dbs.dbPath, wait)
+	if err != nil || file == nil {
+		return false, err
+	}
+	dbs.lockFile = file
+	return true, nil
+}
+
+// Release the update lock, if held.
+func (dbs *DBSession) UnlockUpdates() error {
+	if dbs.lockFile == nil {
+		return nil
+	}
+	err := dbs.lockFile.Close()
+	dbs.lockFile = nil
+	return err
+}
+
+// Prepare a transaction to insert a new batch of log entries, returning the time of the last seen log entry,
+// or the time until which entries were pruned if later.
+// If the context is cancelled before FinishUpdate, the transaction is rolled back.
+func (dbs *DBSession) PrepareForUpdate(ctx context.Context) (*time.Time, error) {
 	// we want to avoid processed files that were already processed in the past.  but we still want to add new log entries
 	// from the most recent files, which may have been extended since we last saw them.
 	// Since there is no "uniqueness" in logs (even the same ip can make the same request at the same second ---I checked),
 	// I remove the entries with the highest timestamp, and load everything up until including that timestamp but not older.
-	// The assumption is that any processing was completely finished, not interrupted.
+	// The removal is part of the insert transaction, so the entries are preserved if the processing is interrupted.
+	if err := dbs.PrepareForInsert(ctx); err != nil {
+		return nil, err
+	}
 
 	var lastSeenTimeStr string
 	var lastSeemTime *time.Time
 	// this query error is acceptable in case of db not exists or empty
-	if err := dbs.db.QueryRow("SELECT max(time) FROM access_logs").Scan(&lastSeenTimeStr); err == nil {
+	if err := dbs.insertTx.QueryRow("SELECT max(time) FROM access_logs").Scan(&lastSeenTimeStr); err == nil {
 		query := "DELETE FROM access_logs WHERE time = ?"
-		_, err := dbs.db.Exec(query, lastSeenTimeStr)
+		_, err := dbs.insertTx.Exec(query, lastSeenTimeStr)
 		log.Printf("query: %s %s\n", query, lastSeenTimeStr)
 		if err != nil {
-			return nil, err
+			return nil, dbs.FinishUpdate(err)
 		}
 
 		t, _ := time.Parse(DB_DATE_LAYOUT, lastSeenTimeStr)
 		lastSeemTime = &t
+		dbs.updatedSince = lastSeenTimeStr
 	}
 
-	// prepare transaction for log inserts
-	tx, err := dbs.db.Begin()
+	// the pruned entries are no longer stored, but they shouldn't be loaded again from the log files,
+	// e.g. after every entry was pruned
+	prunedUntil, err := getStateTime(dbs.insertTx, "access_logs_pruned_until")
 	if err != nil {
-		return nil, err
+		return nil, dbs.FinishUpdate(err)
+	}
+	if !prunedUntil.IsZero() && (lastSeemTime == nil || lastSeemTime.Before(prunedUntil)) {
+		lastSeemTime = &prunedUntil
+	}
+
+	return lastSeemTime, nil
+}
+
+// Prepare a transaction to insert a new batch of log entries.
+// Unlike PrepareForUpdate, no previously stored entries are removed, so it's up to the caller
+// to ensure the batch doesn't contain entries already present in the database.
+// If the context is cancelled before FinishUpdate, the transaction is rolled back.
+func (dbs *DBSession) PrepareForInsert(ctx context.Context) error {
+	tx, err := dbs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
-	dbs.insertTx = tx
 
 	insertValuePlaceholder := strings.TrimSuffix(strings.Repeat("?,", len(dbs.columns)), ",")
-	insertStmt, err := dbs.insertTx.Prepare(fmt.Sprintf("INSERT INTO access_logs(%s) values(%s);", strings.Join(dbs.columns, ","), insertValuePlaceholder))
+	insertStmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO access_logs(%s) values(%s);", strings.Join(dbs.columns, ","), insertValuePlaceholder))
 	if err != nil {
-		return nil, err
+		return errors.Join(err, rollback(tx))
 	}
+	dbs.insertTx = tx
 	dbs.insertStmt = insertStmt
-	return lastSeemTime, nil
+	dbs.encoder = newDictionaryEncoder(tx, dbs.dictionaries)
+	return nil
 }
 
 func (dbs *DBSession) AddLogEntry(values []any) error {
-	_, err := dbs.insertStmt.Exec(values...)
+	encodedValues, err := dbs.encoder.encodeValues(dbs.columns, values)
+	if err != nil {
+		return err
+	}
+	_, err = dbs.insertStmt.Exec(encodedValues...)
+	if timeIndex := slices.Index(dbs.columns, "time"); err == nil && timeIndex >= 0 {
+		entryTime, _ := values[timeIndex].(string)
+		if dbs.updatedSince == "" || entryTime < dbs.updatedSince {
+			dbs.updatedSince = entryTime
+		}
+	}
 	return err
 }
 
+// Replace the summary of the ingested log files with the given one, as part of the log insertion transaction.
+// `ingestedAt` is the time of the update.
+func (dbs *DBSession) RecordIngestedFiles(files []*FileStats, ingestedAt time.Time) error {
+	if _, err := dbs.insertTx.Exec("DELETE FROM ingested_files"); err != nil {
+		return err
+	}
+	for _, file := range files {
+		// lines are read with a line scanner, so they can't contain newlines
+		_, err := dbs.insertTx.Exec(
+			"INSERT INTO ingested_files (path, lines, processed, skipped, skipped_samples, ingested_at) VALUES (?, ?, ?, ?, ?, ?)",
+			file.Path, file.Lines, file.Processed, file.Skipped, strings.Join(file.SkippedSamples, "\n"), ingestedAt.UTC().Format(DB_DATE_LAYOUT),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Store a log entry that couldn't be parsed, as part of the log insertion transaction.
+// Lines already stored with the same source and line number are ignored.
+func (dbs *DBSession) AddRejectedLine(rejected *RejectedLine, rejectedAt time.Time) error {
+	_, err := dbs.insertTx.Exec(
+		"INSERT OR IGNORE INTO rejected_lines (source, line_number, line, reason, rejected_at) VALUES (?, ?, ?, ?, ?)",
+		rejected.Source, rejected.LineNumber, rejected.Line, rejected.Reason, rejectedAt.UTC().Format(DB_DATE_LAYOUT),
+	)
+	return err
+}
+
+// Returns the stored rejected lines grouped by reason, with their count and the most recent one of each group
+// as an example.
+func (dbs *DBSession) QueryRejects(ctx context.Context) ([]string, [][]string, error) {
+	query := `SELECT r.reason, g.lines '#lines', datetime(r.rejected_at) last_rejected, r.source || ':' || r.line_number last_source, r.line last_line
+		FROM (SELECT reason, count(1) lines, max(id) last_id FROM rejected_lines GROUP BY reason) g
+		JOIN rejected_lines r ON r.id = g.last_id
+		ORDER BY g.lines DESC`
+	log.Printf("query: %s\n", query)
+	return dbs.queryStrings(ctx, query)
+}
+
 // If the given processing `err` is nil, commit the log insertion transaction,
 // Otherwise roll it back and return the error.
+// When rollups are enabled, the buckets affected by the update are refreshed as part of the same transaction.
 func (dbs *DBSession) FinishUpdate(err error) error {
 	tx := dbs.insertTx
+	updatedSince := dbs.updatedSince
 	dbs.insertTx = nil
 	dbs.insertStmt = nil
+	dbs.encoder = nil
+	dbs.updatedSince = ""
 
+	if err == nil && dbs.rollups {
+		err = dbs.refreshRollups(tx, updatedSince)
+	}
 	if err != nil {
-		return errors.Join(err, tx.Rollback())
+		return errors.Join(err, rollback(tx))
 	}
 	return tx.Commit()
 }
 
+// Roll back the given transaction, ignoring the error of it being already rolled back
+// because its context was cancelled.
+func rollback(tx *sql.Tx) error {
+	if err := tx.Rollback(); !errors.Is(err, sql.ErrTxDone) {
+		return err
+	}
+	return nil
+}
+
 // Build a query from the spec and execute it, returning the results as stringified values.
-func (dbs *DBSession) QueryTop(spec *RequestCountSpec) ([]string, [][]string, error) {
-	queryString, queryArgs := spec.buildQuery()
+// When possible, the rollup tables are used to resolve the parts of the time window they cover.
+// The query is interrupted if the context is cancelled, e.g. when its deadline expires.
+func (dbs *DBSession) QueryTop(ctx context.Context, spec *RequestCountSpec) ([]string, [][]string, error) {
+	segments, err := dbs.planQuery(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+	queryString, queryArgs := spec.buildQuery(segments, dbs.dictionaries)
+	columns, rows, err := dbs.queryStrings(ctx, queryString, queryArgs...)
+	if err == nil && spec.PivotMetric != "" {
+		columns, rows = spec.pivotResults(columns, rows)
+	}
+	if err != nil || len(spec.GroupByMetrics) == 0 || !(spec.Percent || spec.Cumulative || spec.Other) {
+		return columns, rows, err
+	}
 
-	rows, err := dbs.db.Query(queryString, queryArgs...)
+	// the shares are relative to the requests in the window, regardless of the limit and count thresholds
+	totalSpec := &RequestCountSpec{
+		TimeSince: spec.TimeSince,
+		TimeUntil: spec.TimeUntil,
+		Location:  spec.Location,
+		Where:     spec.Where,
+		Limit:     1,
+	}
+	_, totalRows, err := dbs.QueryTop(ctx, totalSpec)
+	if err != nil {
+		return nil, nil, err
+	}
+	total, _ := strconv.Atoi(totalRows[0][0])
+	columns, rows = spec.addShares(columns, rows, total)
+	return columns, rows, nil
+}
+
+// Extend the query results with the "(other)" row and the percentage columns requested by the spec,
+// given the total requests of the window.
+func (spec *RequestCountSpec) addShares(columns []string, rows [][]string, total int) ([]string, [][]string) {
+	countIndex := len(columns) - 1
+	if spec.Other {
+		other := total
+		for _, row := range rows {
+			count, _ := strconv.Atoi(row[countIndex])
+			other -= count
+		}
+		if other > 0 {
+			row := make([]string, len(columns))
+			row[0] = OTHER_RESULTS
+			row[countIndex] = strconv.Itoa(other)
+			rows = append(rows, row)
+		}
+	}
+
+	if spec.Percent {
+		columns = append(columns, "%")
+	}
+	if spec.Cumulative {
+		columns = append(columns, "cum%")
+	}
+	cumulative := 0
+	for i, row := range rows {
+		count, _ := strconv.Atoi(row[countIndex])
+		cumulative += count
+		if spec.Percent {
+			row = append(row, formatPercent(count, total))
+		}
+		if spec.Cumulative {
+			row = append(row, formatPercent(cumulative, total))
+		}
+		rows[i] = row
+	}
+	return columns, rows
+}
+
+func formatPercent(count int, total int) string {
+	if total == 0 {
+		return "0.0%"
+	}
+	return fmt.Sprintf("%.1f%%", float64(count)*100/float64(total))
+}
+
+// Run an arbitrary SQL query, returning the results as stringified values.
+func (dbs *DBSession) QuerySQL(ctx context.Context, query string) ([]string, [][]string, error) {
+	log.Printf("query: %s\n", query)
+	return dbs.queryStrings(ctx, query)
+}
+
+// Run the given query returning its column names and its rows as stringified values.
+func (dbs *DBSession) queryStrings(ctx context.Context, query string, args ...any) ([]string, [][]string, error) {
+	rows, err := dbs.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -154,33 +436,182 @@ func (dbs *DBSession) QueryTop(spec *RequestCountSpec) ([]string, [][]string, er
 	return columns, results, rows.Err()
 }
 
-// Turn the request count specification into an SQL query.
-func (spec *RequestCountSpec) buildQuery() (string, []any) {
+// Turn the request count specification into an SQL query, that gets the counts of each time segment
+// from its table and adds them up.
+// The values of dictionary-encoded columns of the log entries table are decoded, and the ones of virtual fields computed.
+func (spec *RequestCountSpec) buildQuery(segments []querySegment, dicts dictionaries) (string, []any) {
+	var groupByExpression string
+	if len(spec.GroupByMetrics) > 0 {
+		groupByExpression = "GROUP BY"
+		for i := range len(spec.GroupByMetrics) {
+			groupByExpression += fmt.Sprintf(" %d", i+1)
+			if i < len(spec.GroupByMetrics)-1 {
+				groupByExpression += ","
+			}
+		}
+	}
+
+	// the log entries are grouped by the stored column values, so encoded columns are only decoded once per group
+	// (qualified, since the decoded values are aliased with the column names)
+	var entriesColumns, entriesGroupByColumns []string
+	for _, column := range spec.GroupByMetrics {
+		if expression := columnExpression(column, spec.Location); expression != column {
+			// virtual fields can only be grouped by their computed value
+			entriesGroupByColumns = append(entriesGroupByColumns, expression)
+			entriesColumns = append(entriesColumns, expression+" "+column)
+			continue
+		}
+		entriesGroupByColumns = append(entriesGroupByColumns, "access_logs."+column)
+		if dicts[column] {
+			column = dicts.valueExpression(column) + " " + column
+		}
+		entriesColumns = append(entriesColumns, column)
+	}
+	var entriesGroupByExpression string
+	if len(entriesGroupByColumns) > 0 {
+		entriesGroupByExpression = "GROUP BY " + strings.Join(entriesGroupByColumns, ", ")
+	}
+
+	// the simple case, all counts come from the log entries table
+	if len(segments) == 1 && segments[0].table == "access_logs" {
+		whereExpression, queryArgs := spec.whereExpression(segments[0], dicts)
+		columns := strings.Join(append(entriesColumns, "count(1) '#reqs'"), ",")
+		queryString := spec.resultsQuery(fmt.Sprintf(
+			"SELECT %s FROM access_logs %s %s",
+			columns,
+			whereExpression,
+			entriesGroupByExpression,
+		), "count(1)")
+		log.Printf("query: %s %s\n", queryString, queryArgs)
+		return queryString, queryArgs
+	}
+
+	queryArgs := []any{}
+	subqueries := make([]string, len(segments))
+	for i, segment := range segments {
+		whereExpression, whereArgs := spec.whereExpression(segment, dicts)
+		if segment.table == "access_logs" {
+			columns := strings.Join(append(entriesColumns, "count(1) requests"), ",")
+			subqueries[i] = fmt.Sprintf("SELECT %s FROM access_logs %s %s", columns, whereExpression, entriesGroupByExpression)
+		} else {
+			columns := strings.Join(append(slices.Clone(spec.GroupByMetrics), "sum(requests) requests"), ",")
+			subqueries[i] = fmt.Sprintf("SELECT %s FROM %s %s %s", columns, segment.table, whereExpression, groupByExpression)
+		}
+		queryArgs = append(queryArgs, whereArgs...)
+	}
+
+	columns := strings.Join(append(slices.Clone(spec.GroupByMetrics), "coalesce(sum(requests), 0) '#reqs'"), ",")
+	queryString := spec.resultsQuery(fmt.Sprintf(
+		"SELECT %s FROM (%s) %s",
+		columns,
+		strings.Join(subqueries, " UNION ALL "),
+		groupByExpression,
+	), "sum(requests)")
+	log.Printf("query: %s %s\n", queryString, queryArgs)
+	return queryString, queryArgs
+}
+
+// Add the clauses that filter, sort and paginate the grouped results to the query, given the SQL expression of their request count.
+// The numbers are formatted into the query since the limit clause can't be "?".
+func (spec *RequestCountSpec) resultsQuery(query string, countExpression string) string {
+	direction := "DESC"
+	if spec.Ascending {
+		direction = "ASC"
+	}
+	if spec.PivotMetric != "" {
+		return spec.pivotQuery(query, direction)
+	}
+
+	var conditions []string
+	if spec.MinCount > 0 {
+		conditions = append(conditions, fmt.Sprintf("%s >= %d", countExpression, spec.MinCount))
+	}
+	if spec.MaxCount > 0 {
+		conditions = append(conditions, fmt.Sprintf("%s <= %d", countExpression, spec.MaxCount))
+	}
+	if len(conditions) > 0 {
+		query += " HAVING " + strings.Join(conditions, " AND ")
+	}
+
+	if len(spec.PerMetrics) > 0 {
+		return spec.perGroupQuery(query, direction)
+	}
+
+	orderExpression := countExpression + " " + direction
+	if i := slices.Index(spec.GroupByMetrics, spec.SortBy); spec.SortBy != "" && i >= 0 {
+		// fields are referenced by position, since their names can be ambiguous with the decoded values
+		// ties, e.g. when sorting by one of many fields, are broken by the request count
+		orderExpression = fmt.Sprintf("%d %s, %s DESC", i+1, direction, countExpression)
+	}
+	return fmt.Sprintf("%s ORDER BY %s LIMIT %d OFFSET %d", query, orderExpression, spec.Limit, spec.Offset)
+}
+
+// Wrap the grouped results query to get the top results within each group of the PerMetrics fields,
+// for the top groups by total requests.
+// The results are ranked within their group, and the groups by their total, with window functions.
+func (spec *RequestCountSpec) perGroupQuery(query string, direction string) string {
+	partition := strings.Join(quoteColumns(spec.PerMetrics), ", ")
+	columns := strings.Join(quoteColumns(append(slices.Clone(spec.GroupByMetrics), "#reqs")), ", ")
+
+	// a sort field applies either to the groups or to the results within them, and the other is sorted by descending count
+	rowOrder := `"#reqs" ` + direction
+	groupOrder := fmt.Sprintf("group_reqs %s, %s", direction, partition)
+	if slices.Contains(spec.PerMetrics, spec.SortBy) {
+		rowOrder = `"#reqs" DESC`
+		groupOrder = fmt.Sprintf(`"%s" %s, %s`, spec.SortBy, direction, partition)
+	} else if slices.Contains(spec.GroupByMetrics, spec.SortBy) {
+		rowOrder = fmt.Sprintf(`"%s" %s, "#reqs" DESC`, spec.SortBy, direction)
+		groupOrder = "group_reqs DESC, " + partition
+	}
+
+	return fmt.Sprintf(
+		`SELECT %s FROM (
+			SELECT *, dense_rank() OVER (ORDER BY %s) group_rank FROM (
+				SELECT *, row_number() OVER (PARTITION BY %s ORDER BY %s) row_rank, sum("#reqs") OVER (PARTITION BY %s) group_reqs
+				FROM (%s)))
+		WHERE group_rank > %d AND group_rank <= %d AND row_rank <= %d
+		ORDER BY group_rank, row_rank`,
+		columns,
+		groupOrder,
+		partition, rowOrder, partition,
+		query,
+		spec.Offset, spec.Offset+spec.GroupLimit, spec.Limit,
+	)
+}
+
+// Build the WHERE clause to filter the given time segment according to the spec conditions.
+// The conditions on dictionary-encoded columns are only translated for the log entries table,
+// since the rollups store plain values.
+func (spec *RequestCountSpec) whereExpression(segment querySegment, dicts dictionaries) (string, []any) {
 	queryArgs := []any{}
 
-	whereExpression := "WHERE time > ? AND time < ? "
-	queryArgs = append(queryArgs, spec.TimeSince, spec.TimeUntil)
+	var whereExpression string
+	if segment.table == "access_logs" {
+		if segment.sinceInclusive {
+			whereExpression = "WHERE time >= ? AND time < ? "
+		} else {
+			whereExpression = "WHERE time > ? AND time < ? "
+		}
+		// times are compared as strings, so they need to be in the same timezone as the stored ones
+		queryArgs = append(queryArgs, segment.since.UTC(), segment.until.UTC())
+	} else {
+		whereExpression = "WHERE bucket >= ? AND bucket < ? "
+		queryArgs = append(queryArgs, segment.since.UTC().Format(DB_DATE_LAYOUT), segment.until.UTC().Format(DB_DATE_LAYOUT))
+		dicts = nil
+	}
+
 	for column, values := range spec.Where {
 		whereExpression += "AND ("
 
 		for i, value := range values {
-			whereExpression += column
 			isNotEqual := strings.HasPrefix(value, "!")
 			value = strings.TrimPrefix(value, "!")
 
+			operator := "="
 			if strings.ContainsRune(value, '%') {
-				if isNotEqual {
-					whereExpression += " NOT LIKE ?"
-				} else {
-					whereExpression += " LIKE ?"
-				}
-			} else {
-				if isNotEqual {
-					whereExpression += " <> ?"
-				} else {
-					whereExpression += " = ?"
-				}
+				operator = "LIKE"
 			}
+			whereExpression += dicts.condition(columnExpression(column, spec.Location), operator, isNotEqual)
 			queryArgs = append(queryArgs, value)
 			if i < len(values)-1 {
 				if isNotEqual {
@@ -192,28 +623,5 @@ func (spec *RequestCountSpec) buildQuery() (string, []any) {
 		}
 		whereExpression += ") "
 	}
-
-	columns := strings.Join(append(spec.GroupByMetrics, "count(1) '#reqs'"), ",")
-	var groupByExpression string
-	if len(spec.GroupByMetrics) > 0 {
-		groupByExpression = "GROUP BY"
-		for i := range len(spec.GroupByMetrics) {
-			groupByExpression += fmt.Sprintf(" %d", i+1)
-			if i < len(spec.GroupByMetrics)-1 {
-				groupByExpression += ","
-			}
-		}
-	}
-
-	queryString := fmt.Sprintf(
-		"SELECT %s FROM access_logs %s %s ORDER BY count(1) DESC LIMIT %d",
-		columns,
-		whereExpression,
-		groupByExpression,
-		spec.Limit, // the limit clause can't be "?"
-	)
-
-	log.Printf("query: %s %s\n", queryString, queryArgs)
-
-	return queryString, queryArgs
+	return whereExpression, queryArgs
 }
@@ -0,0 +1,184 @@
+package ngtop
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCancelledUpdate(t *testing.T) {
+	dbFile, err := os.CreateTemp("", "ngtop.db")
+	assertEqual(t, err, nil)
+	defer os.Remove(dbFile.Name())
+
+	parser := NewParser(DEFAULT_LOG_FORMAT)
+	dbs, err := InitDB(dbFile.Name(), parser.Fields)
+	assertEqual(t, err, nil)
+	defer dbs.Close()
+
+	addEntries := func(lines ...string) error {
+		for _, line := range lines {
+			values, err := parser.ParseRecord(map[string]string{"message": line})
+			assertEqual(t, err, nil)
+			if err := dbs.AddLogEntry(values); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	spec := &RequestCountSpec{
+		TimeSince: time.Date(2024, time.July, 23, 0, 0, 0, 0, time.UTC),
+		TimeUntil: time.Date(2024, time.July, 25, 0, 0, 0, 0, time.UTC),
+		Limit:     5,
+	}
+
+	_, err = dbs.PrepareForUpdate(context.Background())
+	assertEqual(t, err, nil)
+	err = addEntries(
+		`xx.xx.xx.xx - - [24/Jul/2024:00:00:28 +0000] "GET /feed HTTP/1.1" 301 169 "-" "FreshRSS/1.24.0 (Linux; https://freshrss.org)"`,
+		`xx.xx.xx.xx - - [24/Jul/2024:00:01:18 +0000] "GET /feed.xml HTTP/1.1" 200 9641 "-" "FreshRSS/1.24.0 (Linux; https://freshrss.org)"`,
+	)
+	err = dbs.FinishUpdate(err)
+	assertEqual(t, err, nil)
+
+	// interrupt an update after the entries of the last seen time were removed
+	ctx, cancel := context.WithCancel(context.Background())
+	lastSeenTime, err := dbs.PrepareForUpdate(ctx)
+	assertEqual(t, err, nil)
+	assert(t, lastSeenTime.Equal(time.Date(2024, time.July, 24, 0, 1, 18, 0, time.UTC)))
+	err = addEntries(`xx.xx.xx.xx - - [24/Jul/2024:00:02:17 +0000] "GET / HTTP/1.1" 200 1120 "-" "FreshRSS/1.24.0 (Linux; https://freshrss.org)"`)
+	assertEqual(t, err, nil)
+	cancel()
+	err = dbs.FinishUpdate(ctx.Err())
+	assert(t, errors.Is(err, context.Canceled))
+
+	// the update is rolled back entirely
+	_, rows, err := dbs.QueryTop(context.Background(), spec)
+	assertEqual(t, err, nil)
+	assertEqual(t, rows, [][]string{{"2"}})
+
+	// queries are interrupted too
+	_, _, err = dbs.QueryTop(ctx, spec)
+	assert(t, errors.Is(err, context.Canceled))
+}
+
+func TestVirtualTimeFields(t *testing.T) {
+	dbFile, err := os.CreateTemp("", "ngtop.db")
+	assertEqual(t, err, nil)
+	defer os.Remove(dbFile.Name())
+
+	parser := NewParser(DEFAULT_LOG_FORMAT)
+	dbs, err := InitDB(dbFile.Name(), parser.Fields)
+	assertEqual(t, err, nil)
+	defer dbs.Close()
+
+	// around the 2024 daylight saving change in Europe/Madrid, at 01:00 UTC of Sunday March 31st
+	err = dbs.PrepareForInsert(context.Background())
+	assertEqual(t, err, nil)
+	for _, timestamp := range []string{"30/Mar/2024:23:30:00 +0000", "31/Mar/2024:00:30:00 +0000", "31/Mar/2024:01:30:00 +0000", "31/Mar/2024:22:30:00 +0000"} {
+		values, err := parser.ParseRecord(map[string]string{"message": `xx.xx.xx.xx - - [` + timestamp + `] "GET / HTTP/1.1" 200 1120 "-" "-"`})
+		assertEqual(t, err, nil)
+		err = dbs.AddLogEntry(values)
+		assertEqual(t, err, nil)
+	}
+	err = dbs.FinishUpdate(nil)
+	assertEqual(t, err, nil)
+
+	madrid, err := time.LoadLocation("Europe/Madrid")
+	assertEqual(t, err, nil)
+	query := func(location *time.Location, groupBy []string, where map[string][]string) [][]string {
+		t.Helper()
+		_, rows, err := dbs.QueryTop(context.Background(), &RequestCountSpec{
+			GroupByMetrics: groupBy,
+			Where:          where,
+			TimeSince:      time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC),
+			TimeUntil:      time.Date(2024, time.May, 1, 0, 0, 0, 0, time.UTC),
+			Location:       location,
+			Limit:          10,
+		})
+		assertEqual(t, err, nil)
+		slices.SortFunc(rows, slices.Compare)
+		return rows
+	}
+
+	assertEqual(t, query(nil, []string{"hour"}, nil), [][]string{{"0", "1"}, {"1", "1"}, {"22", "1"}, {"23", "1"}})
+	assertEqual(t, query(madrid, []string{"hour"}, nil), [][]string{{"0", "2"}, {"1", "1"}, {"3", "1"}})
+	assertEqual(t, query(nil, []string{"date"}, nil), [][]string{{"2024-03-30", "1"}, {"2024-03-31", "3"}})
+	assertEqual(t, query(madrid, []string{"date", "weekday"}, nil), [][]string{{"2024-03-31", "sun", "3"}, {"2024-04-01", "mon", "1"}})
+	assertEqual(t, query(madrid, []string{"month"}, nil), [][]string{{"2024-03", "3"}, {"2024-04", "1"}})
+
+	// virtual fields can be filtered too, case insensitive for weekdays
+	assertEqual(t, query(nil, nil, map[string][]string{"weekday": {"SUN"}}), [][]string{{"3"}})
+	assertEqual(t, query(madrid, nil, map[string][]string{"weekday": {"!sun"}}), [][]string{{"1"}})
+	assertEqual(t, query(madrid, []string{"hour"}, map[string][]string{"hour": {"3", "1"}}), [][]string{{"1", "1"}, {"3", "1"}})
+	assertEqual(t, query(madrid, nil, map[string][]string{"date": {"2024-03-%"}}), [][]string{{"3"}})
+
+	// no conversion is needed for UTC
+	etcUTC, err := time.LoadLocation("Etc/UTC")
+	assertEqual(t, err, nil)
+	assertEqual(t, localTimeExpression(etcUTC), "time")
+	assertEqual(t, localTimeExpression(time.FixedZone("UTC", 0)), "time")
+	assertEqual(t, localTimeExpression(madrid), "local_time(time, 'Europe/Madrid')")
+	assertEqual(t, query(etcUTC, []string{"hour"}, nil), query(nil, []string{"hour"}, nil))
+}
+
+func TestQueryTrends(t *testing.T) {
+	dbFile, err := os.CreateTemp("", "ngtop.db")
+	assertEqual(t, err, nil)
+	defer os.Remove(dbFile.Name())
+
+	parser := NewParser(DEFAULT_LOG_FORMAT)
+	dbs, err := InitDB(dbFile.Name(), parser.Fields)
+	assertEqual(t, err, nil)
+	defer dbs.Close()
+
+	err = dbs.PrepareForInsert(context.Background())
+	assertEqual(t, err, nil)
+	for _, entry := range [][]string{
+		{"24/Jul/2024:00:00:00 +0000", "/feed.xml", "-"},
+		{"24/Jul/2024:00:15:00 +0000", "/feed.xml", "-"},
+		{"24/Jul/2024:00:59:59 +0000", "/feed.xml", "facundo"},
+		{"24/Jul/2024:00:30:00 +0000", "/", "-"},
+		{"24/Jul/2024:00:31:00 +0000", "/", "-"},
+		// outside the window
+		{"24/Jul/2024:01:00:00 +0000", "/", "-"},
+	} {
+		line := fmt.Sprintf(`xx.xx.xx.xx - %s [%s] "GET %s HTTP/1.1" 200 1120 "-" "-"`, entry[2], entry[0], entry[1])
+		values, err := parser.ParseRecord(map[string]string{"message": line})
+		assertEqual(t, err, nil)
+		err = dbs.AddLogEntry(values)
+		assertEqual(t, err, nil)
+	}
+	err = dbs.FinishUpdate(nil)
+	assertEqual(t, err, nil)
+
+	spec := &RequestCountSpec{
+		TimeSince: time.Date(2024, time.July, 23, 23, 59, 0, 0, time.UTC),
+		TimeUntil: time.Date(2024, time.July, 24, 0, 59, 0, 0, time.UTC).Add(time.Minute),
+		Limit:     10,
+	}
+
+	// the rows are matched by their field values, including decoded, virtual and empty ones
+	spec.GroupByMetrics = []string{"path", "hour", "user"}
+	rows := [][]string{{"/feed.xml", "0", "", "2"}, {"/", "0", "", "2"}, {"/feed.xml", "0", "facundo", "1"}, {OTHER_RESULTS, "", "", "1"}}
+	trends, err := dbs.QueryTrends(context.Background(), spec, rows, 4)
+	assertEqual(t, err, nil)
+	assertEqual(t, trends, [][]int{{1, 1, 0, 0}, {0, 0, 2, 0}, {0, 0, 0, 1}, {0, 0, 0, 0}})
+
+	// without fields, the trend of all the requests in the window
+	spec.GroupByMetrics = nil
+	trends, err = dbs.QueryTrends(context.Background(), spec, [][]string{{"5"}}, 2)
+	assertEqual(t, err, nil)
+	assertEqual(t, trends, [][]int{{2, 3}})
+
+	// the trends of all the logs start at the first entry
+	spec.TimeSince = time.Time{}
+	spec.TimeUntil = time.Date(2024, time.July, 24, 1, 0, 0, 0, time.UTC).Add(time.Second)
+	trends, err = dbs.QueryTrends(context.Background(), spec, [][]string{{"6"}}, 2)
+	assertEqual(t, err, nil)
+	assertEqual(t, trends, [][]int{{3, 3}})
+}
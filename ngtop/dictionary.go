@@ -0,0 +1,136 @@
+package ngtop
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Many columns, like user agents, referers or paths, hold a relatively small set of values repeated across
+// most log entries. To save space, the values of these columns are stored once in a dictionary table
+// (dict_<column>), and the access_logs table only stores their ids.
+//
+// The existence of the dictionary table is what determines if a column is encoded, so databases that store
+// a column as plain text, e.g. because it was created before its field was flagged as Dictionary, keep working.
+
+// The set of dictionary-encoded columns in the access_logs table.
+type dictionaries map[string]bool
+
+// Returns the statement to create the dictionary table of the given column,
+// with `valueSpec` as the SQL column specification of its values.
+func dictionaryTableSQL(column string, valueSpec string) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS dict_%s (id INTEGER NOT NULL PRIMARY KEY, value %s NOT NULL UNIQUE)", column, valueSpec)
+}
+
+// Returns the dictionary-encoded columns of the database.
+func loadDictionaries(db execQuerier) (dictionaries, error) {
+	rows, err := db.Query("SELECT substr(name, 6) FROM sqlite_master WHERE type = 'table' AND name LIKE 'dict!_%' ESCAPE '!'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dicts := make(dictionaries)
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		dicts[column] = true
+	}
+	return dicts, rows.Err()
+}
+
+// Returns an SQL expression that evaluates to the value of the given access_logs column,
+// decoding it from its dictionary if necessary.
+func (dicts dictionaries) valueExpression(column string) string {
+	if dicts[column] {
+		return fmt.Sprintf("(SELECT value FROM dict_%s WHERE id = access_logs.%s)", column, column)
+	}
+	return column
+}
+
+// Returns an SQL condition that compares the value of the given access_logs column with a `?` argument,
+// using the given `operator` (e.g. `=` or `LIKE`), or its negation if `negated` is true.
+// Encoded columns are compared through their dictionary table, so indexes can still be used.
+func (dicts dictionaries) condition(column string, operator string, negated bool) string {
+	if dicts[column] {
+		inOperator := "IN"
+		if negated {
+			inOperator = "NOT IN"
+		}
+		return fmt.Sprintf("%s %s (SELECT id FROM dict_%s WHERE value %s ?)", column, inOperator, column, operator)
+	}
+
+	if negated {
+		if operator == "=" {
+			operator = "<>"
+		} else {
+			operator = "NOT " + operator
+		}
+	}
+	return fmt.Sprintf("%s %s ?", column, operator)
+}
+
+// Delete the dictionary values that are no longer referenced by any log entry, e.g. after pruning.
+func (dicts dictionaries) deleteUnused(tx *sql.Tx) error {
+	for column := range dicts {
+		query := fmt.Sprintf("DELETE FROM dict_%s WHERE id NOT IN (SELECT %s FROM access_logs WHERE %s IS NOT NULL)", column, column, column)
+		if _, err := tx.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Translates the values of encoded columns to their dictionary ids within a transaction, adding the ones
+// not seen before to the dictionaries. The ids are cached, since most values are repeated many times.
+type dictionaryEncoder struct {
+	tx    *sql.Tx
+	dicts dictionaries
+	ids   map[string]map[string]int64
+}
+
+func newDictionaryEncoder(tx *sql.Tx, dicts dictionaries) *dictionaryEncoder {
+	return &dictionaryEncoder{tx: tx, dicts: dicts, ids: make(map[string]map[string]int64)}
+}
+
+// Returns a copy of the given values, in the order of `columns`, with the ones of encoded columns replaced by their ids.
+func (encoder *dictionaryEncoder) encodeValues(columns []string, values []any) ([]any, error) {
+	encoded := make([]any, len(values))
+	for i, value := range values {
+		strValue, isString := value.(string)
+		if !isString || !encoder.dicts[columns[i]] {
+			encoded[i] = value
+			continue
+		}
+		id, err := encoder.id(columns[i], strValue)
+		if err != nil {
+			return nil, err
+		}
+		encoded[i] = id
+	}
+	return encoded, nil
+}
+
+// Returns the id of the value in the dictionary of the given column, adding it if necessary.
+func (encoder *dictionaryEncoder) id(column string, value string) (int64, error) {
+	columnIds, found := encoder.ids[column]
+	if !found {
+		columnIds = make(map[string]int64)
+		encoder.ids[column] = columnIds
+	}
+	if id, found := columnIds[value]; found {
+		return id, nil
+	}
+
+	if _, err := encoder.tx.Exec(fmt.Sprintf("INSERT OR IGNORE INTO dict_%s (value) VALUES (?)", column), value); err != nil {
+		return 0, err
+	}
+	// when the dictionary is case insensitive, the id may belong to a value with different case
+	var id int64
+	if err := encoder.tx.QueryRow(fmt.Sprintf("SELECT id FROM dict_%s WHERE value = ?", column), value).Scan(&id); err != nil {
+		return 0, err
+	}
+	columnIds[value] = id
+	return id, nil
+}
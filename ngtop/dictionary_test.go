@@ -0,0 +1,75 @@
+package ngtop
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDictionaryEncoding(t *testing.T) {
+	dbFile, err := os.CreateTemp("", "ngtop.db")
+	assertEqual(t, err, nil)
+	defer os.Remove(dbFile.Name())
+
+	parser := NewParser(DEFAULT_LOG_FORMAT)
+	dbs, err := InitDB(dbFile.Name(), parser.Fields)
+	assertEqual(t, err, nil)
+	defer dbs.Close()
+	assert(t, dbs.dictionaries["path"])
+	assert(t, dbs.dictionaries["user_agent_raw"])
+	assert(t, !dbs.dictionaries["ip"])
+
+	lines := []string{
+		`xx.xx.xx.xx - - [24/Jul/2024:00:00:28 +0000] "GET /feed HTTP/1.1" 301 169 "-" "FreshRSS/1.24.0 (Linux; https://freshrss.org)"`,
+		`xx.xx.xx.xx - - [24/Jul/2024:00:01:18 +0000] "GET /feed HTTP/1.1" 200 9641 "-" "FreshRSS/1.24.0 (Linux; https://freshrss.org)"`,
+		`yy.yy.yy.yy - - [24/Jul/2024:00:02:17 +0000] "get /blog/ HTTP/1.1" 200 1120 "-" "FreshRSS/1.24.0 (Linux; https://freshrss.org)"`,
+		`yy.yy.yy.yy - - [24/Jul/2024:00:03:17 +0000] "GET /Blog/ HTTP/1.1" 200 1120 "-" "FreshRSS/1.24.0 (Linux; https://freshrss.org)"`,
+	}
+	err = dbs.PrepareForInsert(context.Background())
+	assertEqual(t, err, nil)
+	for _, line := range lines {
+		values, err := parser.ParseRecord(map[string]string{"message": line})
+		assertEqual(t, err, nil)
+		err = dbs.AddLogEntry(values)
+		assertEqual(t, err, nil)
+	}
+	err = dbs.FinishUpdate(nil)
+	assertEqual(t, err, nil)
+
+	// repeated values are stored once, case insensitive columns only keep the first variant
+	countValues := func(column string) int {
+		var count int
+		err := dbs.db.QueryRow("SELECT count(1) FROM dict_" + column).Scan(&count)
+		assertEqual(t, err, nil)
+		return count
+	}
+	assertEqual(t, countValues("user_agent_raw"), 1)
+	assertEqual(t, countValues("path"), 3)
+	assertEqual(t, countValues("method"), 1)
+
+	spec := func(groupBy []string, where map[string][]string) *RequestCountSpec {
+		return &RequestCountSpec{
+			GroupByMetrics: groupBy,
+			TimeSince:      time.Date(2024, time.July, 23, 0, 0, 0, 0, time.UTC),
+			TimeUntil:      time.Date(2024, time.July, 25, 0, 0, 0, 0, time.UTC),
+			Limit:          5,
+			Where:          where,
+		}
+	}
+	_, rows, err := dbs.QueryTop(context.Background(), spec([]string{"method", "ip"}, nil))
+	assertEqual(t, err, nil)
+	assertEqual(t, rows, [][]string{{"GET", "xx.xx.xx.xx", "2"}, {"GET", "yy.yy.yy.yy", "2"}})
+
+	_, rows, err = dbs.QueryTop(context.Background(), spec([]string{"path"}, map[string][]string{"path": {"/blog%"}}))
+	assertEqual(t, err, nil)
+	assertEqual(t, len(rows), 2)
+
+	_, rows, err = dbs.QueryTop(context.Background(), spec([]string{"path"}, map[string][]string{"path": {"!/blog/", "!/Blog/"}, "status": {"301"}}))
+	assertEqual(t, err, nil)
+	assertEqual(t, rows, [][]string{{"/feed", "1"}})
+
+	_, rows, err = dbs.QueryTop(context.Background(), spec(nil, map[string][]string{"ua_type": {"bot"}, "method": {"get"}}))
+	assertEqual(t, err, nil)
+	assertEqual(t, rows, [][]string{{"4"}})
+}
@@ -0,0 +1,76 @@
+package ngtop
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// The name of the SQLite driver used to open the database, which extends the default one with the functions below.
+const SQLITE_DRIVER = "sqlite3_ngtop"
+
+// The name of the SQLite driver used to open the database in read-only mode. Attaching other databases is disabled,
+// since it would allow arbitrary queries to create files, e.g. with `ATTACH DATABASE` or `VACUUM INTO`.
+// SQLite attaches databases internally to VACUUM and alter tables, so this can't be done when writing.
+const SQLITE_READONLY_DRIVER = "sqlite3_ngtop_readonly"
+
+func init() {
+	sql.Register(SQLITE_DRIVER, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("local_time", localTime, true)
+		},
+	})
+	sql.Register(SQLITE_READONLY_DRIVER, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			conn.SetLimit(sqlite3.SQLITE_LIMIT_ATTACHED, 0)
+			return conn.RegisterFunc("local_time", localTime, true)
+		},
+	})
+}
+
+// Loading a location reads the timezone database, so they are cached since the same one is used for every row.
+var locations sync.Map
+
+// SQL function that converts a stored log time to the given timezone name, e.g. `Europe/Madrid`,
+// in a format understood by the SQLite date functions.
+// SQLite only supports UTC and the local time of the process, and its time modifiers use fixed offsets,
+// which would be wrong for the times on the other side of a daylight saving change.
+func localTime(value string, timezone string) (string, error) {
+	location, found := locations.Load(timezone)
+	if !found {
+		loaded, err := time.LoadLocation(timezone)
+		if err != nil {
+			return "", err
+		}
+		location, _ = locations.LoadOrStore(timezone, loaded)
+	}
+
+	t, err := time.Parse(DB_DATE_LAYOUT, value)
+	if err != nil {
+		return "", fmt.Errorf("can't parse log time %s: %w", value, err)
+	}
+	return t.In(location.(*time.Location)).Format(time.DateTime), nil
+}
+
+// Returns an SQL expression that evaluates to the time of the log entries in the given location.
+// The times are stored in UTC, so they are used as is when no conversion is needed,
+// instead of calling back the driver for every row.
+func localTimeExpression(location *time.Location) string {
+	if isUTC(location) {
+		return "time"
+	}
+	return fmt.Sprintf("local_time(time, '%s')", location)
+}
+
+// Returns true if the given location is UTC, including the local timezone of a system configured in UTC
+// and aliases like Etc/UTC.
+func isUTC(location *time.Location) bool {
+	if location == nil || location == time.UTC {
+		return true
+	}
+	name, offset := time.Now().In(location).Zone()
+	return name == "UTC" && offset == 0
+}
@@ -0,0 +1,87 @@
+package ngtop
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The SQL query that would be run for a request, along with the plan SQLite would use to run it.
+type QueryExplanation struct {
+	Query string
+	Args  []any
+	// The steps of the query plan, indented as a tree like in the sqlite3 CLI.
+	Plan []string
+}
+
+// The layout the driver uses to bind time arguments.
+const DRIVER_TIME_LAYOUT = "2006-01-02 15:04:05.999999999-07:00"
+
+// Returns the query that QueryTop would run for the spec and its plan, without running it.
+// Only the main query is explained, not the ones that add totals to its results.
+func (dbs *DBSession) ExplainTop(ctx context.Context, spec *RequestCountSpec) (*QueryExplanation, error) {
+	segments, err := dbs.planQuery(spec)
+	if err != nil {
+		return nil, err
+	}
+	query, queryArgs := spec.buildQuery(segments, dbs.dictionaries)
+	return dbs.explain(ctx, query, queryArgs)
+}
+
+// Returns the query that QueryLogs would run for the spec and columns and its plan, without running it.
+func (dbs *DBSession) ExplainLogs(ctx context.Context, spec *RequestCountSpec, columns []string) (*QueryExplanation, error) {
+	query, queryArgs, err := dbs.logsQuery(spec, columns)
+	if err != nil {
+		return nil, err
+	}
+	return dbs.explain(ctx, query, queryArgs)
+}
+
+// Get the plan of the given query from SQLite.
+func (dbs *DBSession) explain(ctx context.Context, query string, args []any) (*QueryExplanation, error) {
+	_, rows, err := dbs.queryStrings(ctx, "EXPLAIN QUERY PLAN "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// each step references its parent step by id, the top level ones have parent 0
+	children := make(map[string][]int)
+	for i, row := range rows {
+		children[row[1]] = append(children[row[1]], i)
+	}
+	var plan []string
+	var addSteps func(parent string, prefix string)
+	addSteps = func(parent string, prefix string) {
+		steps := children[parent]
+		for i, step := range steps {
+			branch, indent := "|--", "|  "
+			if i == len(steps)-1 {
+				branch, indent = "`--", "   "
+			}
+			plan = append(plan, prefix+branch+rows[step][3])
+			addSteps(rows[step][0], prefix+indent)
+		}
+	}
+	addSteps("0", "")
+	return &QueryExplanation{Query: query, Args: args, Plan: plan}, nil
+}
+
+// Returns the query arguments as SQL literals, in the format they are bound by the driver.
+func (explanation *QueryExplanation) FormatArgs() []string {
+	values := make([]string, len(explanation.Args))
+	for i, arg := range explanation.Args {
+		switch arg := arg.(type) {
+		case time.Time:
+			values[i] = "'" + arg.Format(DRIVER_TIME_LAYOUT) + "'"
+		case string:
+			values[i] = "'" + strings.ReplaceAll(arg, "'", "''") + "'"
+		case int:
+			values[i] = strconv.Itoa(arg)
+		default:
+			values[i] = fmt.Sprint(arg)
+		}
+	}
+	return values
+}
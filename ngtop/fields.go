@@ -1,8 +1,11 @@
 package ngtop
 
 import (
+	"fmt"
 	"github.com/mileusna/useragent"
 	"net/url"
+	"regexp"
+	"slices"
 	"strings"
 	"time"
 )
@@ -22,14 +25,25 @@ type LogField struct {
 	ColumnName string
 	// The SQL column specification, e.g. `"TEXT COLLATE NOCASE"` for case insensitive strings
 	ColumnSpec string
+	// Whether the column should be indexed, for fields expected to be commonly used in query filters.
+	Indexed bool
+	// Whether the values should be stored in a dictionary table and referenced by id,
+	// for strings expected to be repeated across many log entries. See `dictionaries`.
+	Dictionary bool
 	// An optional parse function to transform the value extracted from the log field.
-	Parse func(string) string
+	// If it returns an error, the log entry is rejected.
+	Parse func(string) (string, error)
 	// A list of fields that can be derived from the original log value.
 	// E.g., `{"path", "method", "referer"}` for the `request` field.
 	DerivedFields []string
 	// An optional function that extracts derived fields from this one and returns them as a map.
 	// The key of the map should be the ColumnName of the derived field.
 	ParseDerivedFields func(string) map[string]string
+	// For virtual fields, which aren't stored but computed when querying, the SQL expression of their value.
+	// `{time}` is replaced with the log entry time converted to the query timezone.
+	Expression string
+	// A short explanation of the field values, shown by the schema command.
+	Description string
 }
 
 var KNOWN_FIELDS = []LogField{
@@ -37,99 +51,161 @@ var KNOWN_FIELDS = []LogField{
 		LogFormatVar: "time_local",
 		ColumnName:   "time",
 		ColumnSpec:   "TIMESTAMP NOT NULL",
+		Indexed:      true,
 		Parse:        parseTime,
+		Description:  "Time of the request, converted to UTC when stored.",
 	},
 	{
 		LogFormatVar: "time_iso8601",
 		ColumnName:   "time",
 		ColumnSpec:   "TIMESTAMP NOT NULL",
+		Indexed:      true,
 		Parse:        parseIsoTime,
+		Description:  "Time of the request, converted to UTC when stored.",
 	},
 	{
 		LogFormatVar:       "request",
 		ColumnName:         "request_raw",
 		ColumnSpec:         "TEXT",
+		Dictionary:         true,
 		DerivedFields:      []string{"path", "method", "referer"},
 		ParseDerivedFields: parseRequestDerivedFields,
+		Description:        "Full request line, e.g. `GET /index.html HTTP/1.1`.",
 	},
 	{
 		LogFormatVar:       "http_user_agent",
 		ColumnName:         "user_agent_raw",
 		ColumnSpec:         "TEXT",
+		Dictionary:         true,
 		DerivedFields:      []string{"user_agent", "os", "device", "ua_type", "ua_url"},
 		ParseDerivedFields: parseUserAgentDerivedFields,
+		Description:        "Full User-Agent header of the request.",
 	},
 	{
 		LogFormatVar: "http_referer",
 		CLINames:     []string{"referer", "ref", "referrer"},
 		ColumnName:   "referer",
 		ColumnSpec:   "TEXT COLLATE NOCASE",
-		Parse:        stripUrlSource,
+		Dictionary:   true,
+		Indexed:      true,
+		Parse:        parseReferer,
+		Description:  "Referer header, without the scheme, `www.` prefix and trailing slash.",
 	},
 	{
 		LogFormatVar: "remote_addr",
 		CLINames:     []string{"ip"},
 		ColumnName:   "ip",
 		ColumnSpec:   "TEXT",
+		Indexed:      true,
+		Description:  "Client IP address.",
 	},
 	{
 		LogFormatVar: "remote_user",
 		CLINames:     []string{"user", "username", "remote_user", "remoteuser"},
 		ColumnName:   "user",
 		ColumnSpec:   "TEXT",
+		Description:  "User name given with basic authentication.",
 	},
 	{
 		LogFormatVar: "status",
 		CLINames:     []string{"status"},
 		ColumnName:   "status",
 		ColumnSpec:   "INTEGER",
+		Indexed:      true,
+		Description:  "Response status code.",
 	},
 	{
 		LogFormatVar: "uri",
 		CLINames:     []string{"path", "url", "uri"},
 		ColumnName:   "path",
 		ColumnSpec:   "TEXT",
+		Dictionary:   true,
+		Indexed:      true,
+		Description:  "Request path, without the query string.",
 	},
 	{
 		LogFormatVar: "host",
 		CLINames:     []string{"host", "server"},
 		ColumnName:   "host",
 		ColumnSpec:   "TEXT",
+		Dictionary:   true,
+		Indexed:      true,
+		Description:  "Host header of the request, or the server name if missing.",
 	},
 	{
-		CLINames:   []string{"method"},
-		ColumnName: "method",
-		ColumnSpec: "TEXT COLLATE NOCASE",
+		CLINames:    []string{"method"},
+		ColumnName:  "method",
+		ColumnSpec:  "TEXT COLLATE NOCASE",
+		Dictionary:  true,
+		Description: "Request method, e.g. GET.",
 	},
 	{
-		CLINames:   []string{"path", "url", "uri"},
-		ColumnName: "path",
-		ColumnSpec: "TEXT",
+		CLINames:    []string{"path", "url", "uri"},
+		ColumnName:  "path",
+		ColumnSpec:  "TEXT",
+		Dictionary:  true,
+		Indexed:     true,
+		Description: "Request path, without the query string.",
 	},
 	{
-		CLINames:   []string{"user_agent", "ua", "useragent"},
-		ColumnName: "user_agent",
-		ColumnSpec: "TEXT COLLATE NOCASE",
+		CLINames:    []string{"user_agent", "ua", "useragent"},
+		ColumnName:  "user_agent",
+		ColumnSpec:  "TEXT COLLATE NOCASE",
+		Dictionary:  true,
+		Indexed:     true,
+		Description: "Browser or client name, e.g. Firefox.",
 	},
 	{
-		CLINames:   []string{"os"},
-		ColumnName: "os",
-		ColumnSpec: "TEXT COLLATE NOCASE",
+		CLINames:    []string{"os"},
+		ColumnName:  "os",
+		ColumnSpec:  "TEXT COLLATE NOCASE",
+		Dictionary:  true,
+		Description: "Operating system of the client, e.g. Linux.",
 	},
 	{
-		CLINames:   []string{"device"},
-		ColumnName: "device",
-		ColumnSpec: "TEXT COLLATE NOCASE",
+		CLINames:    []string{"device"},
+		ColumnName:  "device",
+		ColumnSpec:  "TEXT COLLATE NOCASE",
+		Dictionary:  true,
+		Description: "Client device, e.g. iPhone.",
 	},
 	{
-		CLINames:   []string{"ua_url", "uaurl"},
-		ColumnName: "ua_url",
-		ColumnSpec: "TEXT",
+		CLINames:    []string{"ua_url", "uaurl"},
+		ColumnName:  "ua_url",
+		ColumnSpec:  "TEXT",
+		Dictionary:  true,
+		Description: "URL included in the user agent, usually by bots.",
 	},
 	{
-		CLINames:   []string{"ua_type", "uatype"},
-		ColumnName: "ua_type",
-		ColumnSpec: "TEXT COLLATE NOCASE",
+		CLINames:    []string{"ua_type", "uatype"},
+		ColumnName:  "ua_type",
+		ColumnSpec:  "TEXT COLLATE NOCASE",
+		Dictionary:  true,
+		Description: "Kind of client: bot, tablet, mobile or desktop.",
+	},
+	{
+		CLINames:    []string{"hour"},
+		ColumnName:  "hour",
+		Expression:  "CAST(strftime('%H', {time}) AS INTEGER)",
+		Description: "Hour of the day of the request, from 0 to 23.",
+	},
+	{
+		CLINames:    []string{"weekday", "dow"},
+		ColumnName:  "weekday",
+		Expression:  "(substr('sunmontuewedthufrisat', 1 + 3 * strftime('%w', {time}), 3) COLLATE NOCASE)",
+		Description: "Day of the week of the request, e.g. mon.",
+	},
+	{
+		CLINames:    []string{"date", "day"},
+		ColumnName:  "date",
+		Expression:  "date({time})",
+		Description: "Date of the request, e.g. 2024-07-01.",
+	},
+	{
+		CLINames:    []string{"month"},
+		ColumnName:  "month",
+		Expression:  "strftime('%Y-%m', {time})",
+		Description: "Month of the request, e.g. 2024-07.",
 	},
 }
 
@@ -149,6 +225,66 @@ func init() {
 	}
 }
 
+// The variable names that can be used as column names of dynamic fields, without quoting them in SQL statements.
+var DYNAMIC_FIELD_NAME = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// Register a field for a log format variable that isn't known in advance, e.g. `$http_x_forwarded_for` or `$scheme`,
+// so its values are stored in a TEXT column and it can be referred by its variable name in the CLI.
+// Returns nil if the variable name clashes with the column or CLI name of a known field,
+// or if it isn't a valid column name, e.g. regex captures like `$1`.
+func RegisterDynamicField(logvar string) *LogField {
+	if !DYNAMIC_FIELD_NAME.MatchString(logvar) {
+		return nil
+	}
+	if _, found := COLUMN_NAME_TO_FIELD[logvar]; found {
+		return nil
+	}
+	if _, found := CLI_NAME_TO_FIELD[logvar]; found {
+		return nil
+	}
+
+	field := &LogField{
+		LogFormatVar: logvar,
+		CLINames:     []string{logvar},
+		ColumnName:   logvar,
+		ColumnSpec:   "TEXT",
+		Description:  fmt.Sprintf("Value of the $%s log format variable.", logvar),
+	}
+	LOGVAR_TO_FIELD[logvar] = field
+	COLUMN_NAME_TO_FIELD[logvar] = field
+	CLI_NAME_TO_FIELD[logvar] = field
+	return field
+}
+
+// Returns the log format variables the values of the given column can be taken from, e.g. `$uri` and `$request`
+// for `path`, or `time` for virtual fields.
+func ColumnSources(column string) []string {
+	var sources []string
+	for _, field := range KNOWN_FIELDS {
+		if field.ColumnName == column && field.LogFormatVar != "" {
+			sources = append(sources, "$"+field.LogFormatVar)
+		} else if field.ColumnName == column && field.Expression != "" {
+			sources = append(sources, "time")
+		} else if slices.Contains(field.DerivedFields, column) {
+			sources = append(sources, "$"+field.LogFormatVar)
+		}
+	}
+	if field, found := COLUMN_NAME_TO_FIELD[column]; found && len(sources) == 0 && field.LogFormatVar != "" {
+		// dynamic fields
+		sources = append(sources, "$"+field.LogFormatVar)
+	}
+	return sources
+}
+
+// Returns the SQL expression of the given column value: the column itself or, for virtual fields,
+// the expression that computes it with times in the given location.
+func columnExpression(column string, location *time.Location) string {
+	if field, found := COLUMN_NAME_TO_FIELD[column]; found && field.Expression != "" {
+		return strings.ReplaceAll(field.Expression, "{time}", localTimeExpression(location))
+	}
+	return column
+}
+
 func stripUrlSource(value string) string {
 	value = strings.TrimPrefix(value, "http://")
 	value = strings.TrimPrefix(value, "https://")
@@ -157,21 +293,25 @@ func stripUrlSource(value string) string {
 	return value
 }
 
-// FIXME error instead of panic?
-func parseTime(timestamp string) string {
+func parseReferer(referer string) (string, error) {
+	return stripUrlSource(referer), nil
+}
+
+func parseTime(timestamp string) (string, error) {
 	t, err := time.Parse(LOG_DATE_LAYOUT, timestamp)
 	if err != nil {
-		panic("can't parse log timestamp " + timestamp)
+		return "", fmt.Errorf("can't parse log timestamp %s", timestamp)
 	}
-	return t.Format(DB_DATE_LAYOUT)
+	// times are compared as strings, so they need to be in the same timezone
+	return t.UTC().Format(DB_DATE_LAYOUT), nil
 }
 
-func parseIsoTime(timestamp string) string {
+func parseIsoTime(timestamp string) (string, error) {
 	t, err := time.Parse("2006-01-02T15:04:05-07:00", timestamp)
 	if err != nil {
-		panic("can't parse log timestamp " + timestamp)
+		return "", fmt.Errorf("can't parse log timestamp %s", timestamp)
 	}
-	return t.Format(DB_DATE_LAYOUT)
+	return t.UTC().Format(DB_DATE_LAYOUT), nil
 }
 
 func parseRequestDerivedFields(request string) map[string]string {
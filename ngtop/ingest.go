@@ -0,0 +1,202 @@
+package ngtop
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An http.Handler that accepts batches of access log entries, as sent by the HTTP sinks of log shippers
+// like Vector or Fluent Bit, and inserts them into the database.
+type IngestHandler struct {
+	parser *LogParser
+	dbs    *DBSession
+	// the db session supports a single insert transaction at a time, so concurrent requests need to wait their turn
+	mutex sync.Mutex
+}
+
+// The response body sent back to the client after a batch is processed.
+type IngestResult struct {
+	Inserted int `json:"inserted"`
+	Skipped  int `json:"skipped"`
+}
+
+// The maximum size of a batch, both as received and once decompressed, to avoid exhausting the memory
+// since batches are read whole.
+const MAX_BATCH_SIZE = 32 << 20
+
+func NewIngestHandler(parser *LogParser, dbs *DBSession) *IngestHandler {
+	return &IngestHandler{parser: parser, dbs: dbs}
+}
+
+// Parse the request body as a batch of log entries and insert them in a single transaction.
+// The body can be a JSON array of records, newline delimited JSON records or plain log lines,
+// optionally gzip compressed. Entries that can't be parsed are skipped and stored as rejected lines,
+// with the client address as source; if any insertion fails the entire batch is rolled back.
+func (handler *IngestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, MAX_BATCH_SIZE)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = http.MaxBytesReader(w, gzipReader, MAX_BATCH_SIZE)
+	}
+
+	records, err := decodeBatch(body)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, fmt.Sprintf("batch larger than %d bytes", maxBytesErr.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// parse everything before touching the db, so a bad batch doesn't leave a transaction open
+	result := IngestResult{}
+	batch := make([][]any, 0, len(records))
+	var rejects []*RejectedLine
+	for i, record := range records {
+		values, err := handler.parser.ParseRecord(record)
+		if err != nil {
+			// don't fail on parsing error, just skip the entry
+			log.Println(err)
+			result.Skipped++
+			rejects = append(rejects, newRejectedLine("http "+r.RemoteAddr, i+1, recordLine(record), err))
+			continue
+		}
+		batch = append(batch, values)
+	}
+
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+
+	// other processes, like a cron job loading local logs, may be updating the db too
+	if _, err := handler.dbs.LockUpdates(true); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer handler.dbs.UnlockUpdates()
+
+	// if the client disconnects, the request context is cancelled and the batch rolled back
+	if err := handler.dbs.PrepareForInsert(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, values := range batch {
+		if err = handler.dbs.AddLogEntry(values); err != nil {
+			break
+		}
+		result.Inserted++
+	}
+	for _, rejected := range rejects {
+		if err != nil {
+			break
+		}
+		err = handler.dbs.AddRejectedLine(rejected, time.Now())
+	}
+	if err := handler.dbs.FinishUpdate(err); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("inserted %d log entries, skipped %d\n", result.Inserted, result.Skipped)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// Decode a batch of log records, detecting the payload encoding from its first character:
+// a JSON array (Vector `json` encoding, Fluent Bit `json` format), newline delimited JSON objects
+// (Vector `ndjson`, Fluent Bit `json_lines`) or plain text lines (Vector `text`).
+// Plain lines are returned as records with a single `message` key.
+func decodeBatch(body io.Reader) ([]map[string]string, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSpace(data)
+
+	// use numbers to preserve their original representation, e.g. don't turn large integers into floats
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var records []map[string]string
+	switch {
+	case len(data) == 0:
+		return records, nil
+
+	case data[0] == '[':
+		var objects []map[string]any
+		if err := decoder.Decode(&objects); err != nil {
+			return nil, err
+		}
+		for _, object := range objects {
+			records = append(records, stringifyRecord(object))
+		}
+
+	case data[0] == '{':
+		for decoder.More() {
+			var object map[string]any
+			if err := decoder.Decode(&object); err != nil {
+				return nil, err
+			}
+			records = append(records, stringifyRecord(object))
+		}
+
+	default:
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				records = append(records, map[string]string{"message": line})
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// Returns the raw log line of the record, or its JSON representation if it doesn't have one.
+func recordLine(record map[string]string) string {
+	if line, isRawLine := record["message"]; isRawLine {
+		return line
+	}
+	if line, isRawLine := record["log"]; isRawLine {
+		return line
+	}
+	data, _ := json.Marshal(record)
+	return string(data)
+}
+
+// Convert the scalar values of a decoded JSON object to strings, as they would appear in a log line.
+// Nulls and nested values are discarded.
+func stringifyRecord(object map[string]any) map[string]string {
+	record := make(map[string]string)
+	for key, value := range object {
+		switch value := value.(type) {
+		case string:
+			record[key] = value
+		case json.Number, bool:
+			record[key] = fmt.Sprint(value)
+		}
+	}
+	return record
+}
@@ -0,0 +1,76 @@
+package ngtop
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIngestHandler(t *testing.T) {
+	dbFile, err := os.CreateTemp("", "ngtop.db")
+	assertEqual(t, err, nil)
+	defer os.Remove(dbFile.Name())
+	defer os.Remove(dbFile.Name() + ".lock")
+
+	parser := NewParser(DEFAULT_LOG_FORMAT)
+	dbs, err := InitDB(dbFile.Name(), parser.Fields)
+	assertEqual(t, err, nil)
+	defer dbs.Close()
+	handler := NewIngestHandler(parser, dbs)
+
+	// vector json encoding, with one line in a different format
+	status, body := postBatch(handler, `[
+		{"message": "xx.xx.xx.xx - - [24/Jul/2024:00:00:28 +0000] \"GET /feed HTTP/1.1\" 301 169 \"-\" \"feedi/0.1.0 (+https://github.com/facundoolano/feedi)\"", "host": "web1"},
+		{"message": "this has a different format"}
+	]`)
+	assertEqual(t, status, http.StatusOK)
+	assertEqual(t, body, `{"inserted":1,"skipped":1}`)
+
+	// fluent bit json_lines with structured nginx variables
+	status, body = postBatch(handler, `{"date": 1721779229.0, "remote_addr": "xx.xx.xx.xx", "time_local": "24/Jul/2024:00:00:29 +0000", "request": "GET /feed.xml HTTP/1.1", "status": 200}
+{"date": 1721779230.0, "remote_addr": "xx.xx.xx.xx", "time_local": "24/Jul/2024:00:00:30 +0000", "request": "GET /feed.xml HTTP/1.1", "status": 200}`)
+	assertEqual(t, status, http.StatusOK)
+	assertEqual(t, body, `{"inserted":2,"skipped":0}`)
+
+	// plain text lines
+	status, body = postBatch(handler, `xx.xx.xx.xx - - [24/Jul/2024:00:00:31 +0000] "GET /feed HTTP/1.1" 301 169 "-" "feedi/0.1.0 (+https://github.com/facundoolano/feedi)"`)
+	assertEqual(t, status, http.StatusOK)
+	assertEqual(t, body, `{"inserted":1,"skipped":0}`)
+
+	// malformed json is rejected
+	status, _ = postBatch(handler, `[{"message": `)
+	assertEqual(t, status, http.StatusBadRequest)
+
+	// batches are limited in size
+	status, _ = postBatch(handler, strings.Repeat(" ", MAX_BATCH_SIZE+1))
+	assertEqual(t, status, http.StatusRequestEntityTooLarge)
+
+	spec := &RequestCountSpec{
+		GroupByMetrics: []string{"path", "status"},
+		TimeSince:      time.Date(2024, time.July, 24, 0, 0, 0, 0, time.UTC),
+		TimeUntil:      time.Date(2024, time.July, 25, 0, 0, 0, 0, time.UTC),
+		Limit:          5,
+	}
+	_, rows, err := dbs.QueryTop(context.Background(), spec)
+	assertEqual(t, err, nil)
+	assertEqual(t, rows, [][]string{{"/feed", "301", "2"}, {"/feed.xml", "200", "2"}})
+
+	// the skipped entry is kept as a rejected line
+	_, rows, err = dbs.QueryRejects(context.Background())
+	assertEqual(t, err, nil)
+	assertEqual(t, len(rows), 1)
+	assertEqual(t, rows[0][0], "line didn't match the log format")
+	assertEqual(t, rows[0][1], "1")
+	assertEqual(t, rows[0][4], "this has a different format")
+}
+
+func postBatch(handler http.Handler, body string) (int, string) {
+	request := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder.Code, strings.TrimSpace(recorder.Body.String())
+}
@@ -0,0 +1,26 @@
+package ngtop
+
+import (
+	"os"
+)
+
+// Different processes may write to the same database at once, e.g. a cron job loading the logs while ngtop
+// is run interactively, or while the serve command ingests log batches. SQLite serializes the write transactions,
+// but loading the logs isn't safe to run concurrently: both processes would see the same last entry time and insert
+// the newer entries twice. To prevent this, updates are guarded with an advisory lock on a file next to the database.
+
+// Open, creating it if necessary, the lock file of the given database and acquire an exclusive lock on it.
+// When `wait` is false and the lock is held by another process, nil is returned without waiting.
+// The lock is released by closing the file.
+func lockDB(dbPath string, wait bool) (*os.File, error) {
+	file, err := os.OpenFile(dbPath+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	locked, err := lockFile(file, wait)
+	if err != nil || !locked {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
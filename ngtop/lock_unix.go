@@ -0,0 +1,27 @@
+//go:build unix
+
+package ngtop
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Acquire an exclusive flock on the given file, returning false if `wait` is false and it's held by another process.
+func lockFile(file *os.File, wait bool) (bool, error) {
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	for {
+		err := syscall.Flock(int(file.Fd()), how)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+}
@@ -0,0 +1,50 @@
+package ngtop
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Get the log entries in the spec time window that match its where conditions, in time order, with their time
+// as the first column followed by the given ones.
+// If the spec has a positive limit, only the most recent entries up to it are returned.
+// The times are returned in DB_DATE_LAYOUT, and entries with the same time are sorted in the order they were inserted.
+func (dbs *DBSession) QueryLogs(ctx context.Context, spec *RequestCountSpec, columns []string) ([]string, [][]string, error) {
+	query, queryArgs, err := dbs.logsQuery(spec, columns)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dbs.queryStrings(ctx, query, queryArgs...)
+}
+
+// Build the query of the log entries requested to QueryLogs.
+func (dbs *DBSession) logsQuery(spec *RequestCountSpec, columns []string) (string, []any, error) {
+	// the stored text, instead of the driver's conversion of timestamp columns
+	expressions := []string{"CAST(time AS TEXT) time"}
+	for _, column := range columns {
+		expression := columnExpression(column, spec.Location)
+		if expression == column {
+			if !dbs.tableColumns[column] {
+				return "", nil, fmt.Errorf("%s is not stored in the DB", column)
+			}
+			expression = dbs.dictionaries.valueExpression(column)
+		}
+		expressions = append(expressions, expression+" "+column)
+	}
+
+	whereExpression, queryArgs := spec.whereExpression(querySegment{table: "access_logs", since: spec.TimeSince, until: spec.TimeUntil}, dbs.dictionaries)
+	query := fmt.Sprintf("SELECT %s FROM access_logs %s ORDER BY time, rowid", strings.Join(expressions, ", "), whereExpression)
+	if spec.Limit > 0 {
+		// get the most recent entries and sort them back, aliasing them so the dictionary values can be looked up
+		query = fmt.Sprintf(
+			"SELECT %s FROM (SELECT rowid, * FROM access_logs %s ORDER BY time DESC, rowid DESC LIMIT %d) access_logs ORDER BY time, rowid",
+			strings.Join(expressions, ", "),
+			whereExpression,
+			spec.Limit,
+		)
+	}
+	log.Printf("query: %s %s\n", query, queryArgs)
+	return query, queryArgs, nil
+}
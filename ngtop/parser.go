@@ -3,17 +3,22 @@ package ngtop
 import (
 	"bufio"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"time"
 )
 
 const LOG_DATE_LAYOUT = "02/Jan/2006:15:04:05 -0700"
 
+// The maximum amount of skipped lines kept as samples for each parsed file.
+const SKIPPED_SAMPLES_LIMIT = 5
+
 type LogParser struct {
 	// The regular expression pattern used to extract fields from log entries.
 	// Derived from a format string.
@@ -25,7 +30,15 @@ type LogParser struct {
 }
 
 // Returns a new parser instance prepared to process logs in the given format.
+// Variables in the format that don't correspond to a known field are registered as dynamic fields,
+// so their values are also extracted and stored.
 func NewParser(format string) *LogParser {
+	for _, logvar := range formatVars(format) {
+		if _, isKnownField := LOGVAR_TO_FIELD[logvar]; !isKnownField {
+			RegisterDynamicField(logvar)
+		}
+	}
+
 	parser := LogParser{
 		formatRegex: formatToRegex(format),
 	}
@@ -54,26 +67,88 @@ func NewParser(format string) *LogParser {
 	return &parser
 }
 
+// The error returned when a log entry can't be parsed.
+type ParseError struct {
+	// A short description of the problem, without details of the specific entry, so errors can be grouped by it.
+	Reason string
+	Err    error
+}
+
+func (err *ParseError) Error() string {
+	if err.Err == nil {
+		return err.Reason
+	}
+	return err.Reason + ": " + err.Err.Error()
+}
+
+func (err *ParseError) Unwrap() error {
+	return err.Err
+}
+
+// A log entry that couldn't be parsed.
+type RejectedLine struct {
+	// where the entry was read from, e.g. the log file path
+	Source     string
+	LineNumber int
+	Line       string
+	Reason     string
+}
+
+// Returns a RejectedLine for the given parsing error.
+func newRejectedLine(source string, lineNumber int, line string, err error) *RejectedLine {
+	rejected := &RejectedLine{Source: source, LineNumber: lineNumber, Line: line, Reason: err.Error()}
+	if parseErr, ok := err.(*ParseError); ok {
+		rejected.Reason = parseErr.Reason
+	}
+	return rejected
+}
+
+// A summary of the lines read from a log file.
+type FileStats struct {
+	Path string
+	// the amount of lines read from the file, including the ones older than the `until` time
+	Lines int
+	// the amount of lines passed to the process function
+	Processed int
+	// the amount of lines that couldn't be parsed, and the first few of them as samples
+	Skipped        int
+	SkippedSamples []string
+}
+
+// Record the given line as skipped.
+func (stats *FileStats) skip(line string) {
+	stats.Skipped++
+	if len(stats.SkippedSamples) < SKIPPED_SAMPLES_LIMIT {
+		stats.SkippedSamples = append(stats.SkippedSamples, line)
+	}
+}
+
 // Parse the fields in the nginx access logs since the `until` time, passing them as a slice to the `processFun`,
 // in the same order as they appear in `parser.Fields1`.
-// Processing is interrupted when a log older than `until` is found.
+// Processing is interrupted when a log older than `until` is found, or with the context error if it's cancelled.
 // Files with '.gz' extension are gzip decompressed before processing; the rest are assumed to be plain text.
+// Lines that can't be parsed are skipped and passed to the `rejectFun`, unless they are surrounded by entries
+// older than `until`, in which case they are assumed to have been rejected by a previous run.
+// Returns a summary of the lines read from each of the processed files.
 func (parser LogParser) Parse(
+	ctx context.Context,
 	logFiles []string,
 	until *time.Time,
 	processFun func([]any) error,
-) error {
+	rejectFun func(*RejectedLine) error,
+) ([]*FileStats, error) {
 	var untilStr string
 	if until != nil {
-		untilStr = until.Format(DB_DATE_LAYOUT)
+		untilStr = until.UTC().Format(DB_DATE_LAYOUT)
 	}
 
+	var fileStats []*FileStats
 	for _, path := range logFiles {
 
 		log.Printf("parsing %s until %s", path, until)
 		file, err := os.Open(path)
 		if err != nil {
-			return err
+			return fileStats, err
 		}
 		defer file.Close()
 
@@ -81,22 +156,48 @@ func (parser LogParser) Parse(
 		var reader io.Reader = file
 		if filepath.Ext(path) == ".gz" {
 			if reader, err = gzip.NewReader(file); err != nil {
-				return err
+				return fileStats, err
 			}
 		}
 
+		stats := &FileStats{Path: path}
+		fileStats = append(fileStats, stats)
 		scanner := bufio.NewScanner(reader)
 		alreadySeenFile := false
+		// rejected lines can't be compared with `until`, so they are held until the next parsed entry tells
+		// if they were already seen. Lines following an already seen entry are discarded right away
+		var pendingRejects []*RejectedLine
+		previousSeen := false
+		flushRejects := func() error {
+			for _, rejected := range pendingRejects {
+				if err := rejectFun(rejected); err != nil {
+					return err
+				}
+			}
+			pendingRejects = nil
+			return nil
+		}
+
 		for scanner.Scan() {
+			if err := ctx.Err(); err != nil {
+				return fileStats, err
+			}
 			line := scanner.Text()
+			stats.Lines++
 			values, err := parseLogLine(parser.formatRegex, line)
 			if err != nil {
 				// don't break on parsing error, just skip the line
 				log.Println(err)
-				continue
-			}
-			if values == nil {
-				log.Printf("couldn't parse line %s", line)
+				stats.skip(line)
+				if !previousSeen {
+					pendingRejects = append(pendingRejects, newRejectedLine(path, stats.Lines, line, err))
+				}
+				if untilStr == "" {
+					// nothing was seen before, no need to wait
+					if err := flushRejects(); err != nil {
+						return fileStats, err
+					}
+				}
 				continue
 			}
 
@@ -105,28 +206,75 @@ func (parser LogParser) Parse(
 				// Since the files contains oldest entries at the beginning, we need to keep parsing until the end to get
 				// all the updates, but we flag it as already seen so we skip parsing newer ones
 				alreadySeenFile = true
+				previousSeen = true
+				pendingRejects = nil
 				continue
 			}
 
-			valueList := make([]any, len(parser.Fields))
-			for i, field := range parser.Fields {
-				valueList[i] = values[field.ColumnName]
+			previousSeen = false
+			if err := flushRejects(); err != nil {
+				return fileStats, err
 			}
-			if err := processFun(valueList); err != nil {
-				return err
+			if err := processFun(parser.valueList(values)); err != nil {
+				return fileStats, err
 			}
+			stats.Processed++
 		}
 		if err := scanner.Err(); err != nil {
-			return err
+			return fileStats, err
+		}
+		if err := flushRejects(); err != nil {
+			return fileStats, err
 		}
 
 		if alreadySeenFile {
 			log.Printf("%s contains older dates than %s, skipping older files", path, untilStr)
-			return nil
+			return fileStats, nil
 		}
 	}
 
-	return nil
+	return fileStats, nil
+}
+
+// Parse a single log entry, as received from a log shipper, into a slice of values
+// in the same order as they appear in `parser.Fields`.
+// If the record contains a `message` or `log` key, its value is assumed to be a raw log line in the parser format,
+// as sent by Vector and Fluent Bit respectively. Otherwise the record keys are treated as log format variable names,
+// e.g. as produced by a JSON nginx `log_format`.
+func (parser LogParser) ParseRecord(record map[string]string) ([]any, error) {
+	line, isRawLine := record["message"]
+	if !isRawLine {
+		line, isRawLine = record["log"]
+	}
+
+	var values map[string]string
+	var err error
+	if isRawLine {
+		values, err = parseLogLine(parser.formatRegex, line)
+	} else {
+		logvars := make(map[string]string)
+		for key, value := range record {
+			logvars[strings.TrimPrefix(key, "$")] = value
+		}
+		values, err = parseLogVars(logvars)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if values["time"] == "" {
+		return nil, &ParseError{Reason: "missing timestamp", Err: fmt.Errorf("%v", record)}
+	}
+	return parser.valueList(values), nil
+}
+
+// Turn a map of parsed values into a slice in the same order as they appear in `parser.Fields`.
+func (parser LogParser) valueList(values map[string]string) []any {
+	valueList := make([]any, len(parser.Fields))
+	for i, field := range parser.Fields {
+		valueList[i] = values[field.ColumnName]
+	}
+	return valueList
 }
 
 // Constructs a regular expression from the given format string, converting known variable names
@@ -173,6 +321,25 @@ func formatToRegex(format string) *regexp.Regexp {
 	return regexp.MustCompile(newFormat)
 }
 
+// Returns the names of the variables (without the leading $) found in the given format string.
+func formatVars(format string) []string {
+	var varnames []string
+	chars := []rune(format)
+	for i := 0; i < len(chars); i++ {
+		if chars[i] == '$' {
+			varname := ""
+			for j := i + 1; j < len(chars) && isVariableNameRune(chars[j]); j++ {
+				varname += string(chars[j])
+			}
+			i += len(varname)
+			if varname != "" {
+				varnames = append(varnames, varname)
+			}
+		}
+	}
+	return varnames
+}
+
 func isVariableNameRune(char rune) bool {
 	return (char >= 'a' && char <= 'z') || char == '_' || (char >= '0' && char <= '9')
 }
@@ -183,25 +350,54 @@ func isVariableNameRune(char rune) bool {
 func parseLogLine(pattern *regexp.Regexp, line string) (map[string]string, error) {
 	match := pattern.FindStringSubmatch(line)
 	if match == nil {
-		return nil, fmt.Errorf("log line didn't match format:\nformat:%s\nline:%s", pattern, line)
+		return nil, &ParseError{Reason: "line didn't match the log format", Err: fmt.Errorf("format:%s\nline:%s", pattern, line)}
 	}
 
-	result := make(map[string]string)
+	logvars := make(map[string]string)
 	for i, logvar := range pattern.SubexpNames() {
-		field := LOGVAR_TO_FIELD[logvar]
-		if logvar != "" && match[i] != "-" {
-			if field.Parse != nil {
-				result[field.ColumnName] = field.Parse(match[i])
-			} else {
-				result[field.ColumnName] = match[i]
+		if logvar != "" {
+			logvars[logvar] = match[i]
+		}
+	}
+	return parseLogVars(logvars)
+}
+
+// Passes the given log format variable values (keyed by variable name, without the leading $)
+// to the parser and derived parser functions of their corresponding LogField.
+// Unknown variables and empty values are ignored. Values taken directly from a variable take precedence
+// over the ones derived from another, e.g. `$http_referer` is preferred over the `utm_source` in the `$request`.
+// Extracted fields are returned as maps with field.ColumnName as key.
+// Fails with a ParseError if any of the field parse functions fails.
+func parseLogVars(logvars map[string]string) (map[string]string, error) {
+	result := make(map[string]string)
+	derived := make(map[string]string)
+	for logvar, value := range logvars {
+		field, isKnownField := LOGVAR_TO_FIELD[logvar]
+		if !isKnownField || value == "-" || value == "" {
+			continue
+		}
+
+		if field.Parse != nil {
+			parsed, err := field.Parse(value)
+			if err != nil {
+				return nil, &ParseError{Reason: "invalid $" + logvar + " value", Err: err}
 			}
+			result[field.ColumnName] = parsed
+		} else {
+			result[field.ColumnName] = value
+		}
 
-			if field.ParseDerivedFields != nil {
-				for key, value := range field.ParseDerivedFields(match[i]) {
-					result[key] = value
-				}
+		if field.ParseDerivedFields != nil {
+			for key, value := range field.ParseDerivedFields(value) {
+				derived[key] = value
 			}
 		}
 	}
+
+	for key, value := range derived {
+		if _, found := result[key]; !found {
+			result[key] = value
+		}
+	}
 	return result, nil
 }
@@ -1,8 +1,12 @@
 package ngtop
 
 import (
+	"context"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 const DEFAULT_LOG_FORMAT = `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"`
@@ -56,6 +60,75 @@ func TestRefererOverride(t *testing.T) {
 	assertEqual(t, result["referer"], "olano.dev/feed.xml")
 }
 
+func TestParseFileStats(t *testing.T) {
+	lines := []string{
+		`xx.xx.xx.xx - - [24/Jul/2024:00:00:28 +0000] "GET /feed HTTP/1.1" 301 169 "-" "feedi/0.1.0 (+https://github.com/facundoolano/feedi)"`,
+		`already rejected`,
+		`xx.xx.xx.xx - - [24/Jul/2024:00:00:30 +0000] "GET /feed HTTP/1.1" 301 169 "-" "feedi/0.1.0 (+https://github.com/facundoolano/feedi)"`,
+	}
+	for i := range SKIPPED_SAMPLES_LIMIT + 2 {
+		lines = append(lines, strings.Repeat("not a log line ", i+1))
+	}
+	logFile, err := os.CreateTemp("", "access.log")
+	assertEqual(t, err, nil)
+	defer os.Remove(logFile.Name())
+	_, err = logFile.WriteString(strings.Join(lines, "\n"))
+	assertEqual(t, err, nil)
+
+	parser := NewParser(DEFAULT_LOG_FORMAT)
+	until := time.Date(2024, time.July, 24, 0, 0, 29, 0, time.UTC)
+	processed := 0
+	var rejects []*RejectedLine
+	stats, err := parser.Parse(context.Background(), []string{logFile.Name()}, &until, func(values []any) error {
+		processed++
+		return nil
+	}, func(rejected *RejectedLine) error {
+		rejects = append(rejects, rejected)
+		return nil
+	})
+	assertEqual(t, err, nil)
+	assertEqual(t, processed, 1)
+	assertEqual(t, len(stats), 1)
+	assertEqual(t, *stats[0], FileStats{
+		Path:           logFile.Name(),
+		Lines:          len(lines),
+		Processed:      1,
+		Skipped:        SKIPPED_SAMPLES_LIMIT + 3,
+		SkippedSamples: append([]string{lines[1]}, lines[3:2+SKIPPED_SAMPLES_LIMIT]...),
+	})
+
+	// the line following an entry older than `until` was rejected by a previous run
+	assertEqual(t, len(rejects), SKIPPED_SAMPLES_LIMIT+2)
+	assertEqual(t, *rejects[0], RejectedLine{Source: logFile.Name(), LineNumber: 4, Line: lines[3], Reason: "line didn't match the log format"})
+}
+
+func TestFieldParseErrors(t *testing.T) {
+	pattern := formatToRegex(DEFAULT_LOG_FORMAT)
+	line := `xx.xx.xx.xx - - [24/Jul/2024:25:00:28 +0000] "GET /feed HTTP/1.1" 301 169 "-" "feedi/0.1.0 (+https://github.com/facundoolano/feedi)"`
+	_, err := parseLogLine(pattern, line)
+	parseErr, ok := err.(*ParseError)
+	assert(t, ok)
+	assertEqual(t, parseErr.Reason, "invalid $time_local value")
+
+	parser := NewParser("$time_iso8601 $request")
+	_, err = parser.ParseRecord(map[string]string{"time_iso8601": "yesterday", "request": "GET / HTTP/1.1"})
+	parseErr, ok = err.(*ParseError)
+	assert(t, ok)
+	assertEqual(t, parseErr.Reason, "invalid $time_iso8601 value")
+
+	_, err = parser.ParseRecord(map[string]string{"request": "GET / HTTP/1.1"})
+	parseErr, ok = err.(*ParseError)
+	assert(t, ok)
+	assertEqual(t, parseErr.Reason, "missing timestamp")
+}
+
+func assert(t *testing.T, cond bool) {
+	t.Helper()
+	if !cond {
+		t.Fatalf("condition is false")
+	}
+}
+
 func assertEqual(t *testing.T, a interface{}, b interface{}) {
 	t.Helper()
 	if !reflect.DeepEqual(a, b) {
@@ -0,0 +1,126 @@
+package ngtop
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Wrap the grouped results query to get the request counts of the top rows, grouped by every field but the pivot one,
+// along with the rank of the pivot values by their total requests, so they can be turned into columns by pivotResults.
+// The count thresholds apply to the row totals instead of the individual counts.
+func (spec *RequestCountSpec) pivotQuery(query string, direction string) string {
+	rowColumns := quoteColumns(spec.GroupByMetrics[:len(spec.GroupByMetrics)-1])
+	pivotColumn := quoteColumns([]string{spec.PivotMetric})[0]
+	partition := strings.Join(rowColumns, ", ")
+
+	rowOrder := fmt.Sprintf("row_reqs %s, %s", direction, partition)
+	columnOrder := "column_reqs DESC, " + pivotColumn
+	if spec.SortBy == spec.PivotMetric {
+		rowOrder = "row_reqs DESC, " + partition
+		columnOrder = pivotColumn + " " + direction
+	} else if slices.Contains(spec.GroupByMetrics, spec.SortBy) {
+		rowOrder = fmt.Sprintf(`"%s" %s, %s`, spec.SortBy, direction, partition)
+	}
+
+	conditions := []string{"1"}
+	if spec.MinCount > 0 {
+		conditions = append(conditions, fmt.Sprintf("row_reqs >= %d", spec.MinCount))
+	}
+	if spec.MaxCount > 0 {
+		conditions = append(conditions, fmt.Sprintf("row_reqs <= %d", spec.MaxCount))
+	}
+
+	// window functions are computed after the WHERE clause, so the rows are ranked after applying the thresholds
+	return fmt.Sprintf(
+		`SELECT %s, "#reqs", row_rank, column_rank FROM (
+			SELECT *, dense_rank() OVER (ORDER BY %s) row_rank, dense_rank() OVER (ORDER BY %s) column_rank FROM (
+				SELECT *, sum("#reqs") OVER (PARTITION BY %s) row_reqs, sum("#reqs") OVER (PARTITION BY %s) column_reqs
+				FROM (%s))
+			WHERE %s)
+		WHERE row_rank > %d AND row_rank <= %d
+		ORDER BY row_rank, column_rank`,
+		strings.Join(quoteColumns(spec.GroupByMetrics), ", "),
+		rowOrder, columnOrder,
+		partition, pivotColumn,
+		query,
+		strings.Join(conditions, " AND "),
+		spec.Offset, spec.Offset+spec.Limit,
+	)
+}
+
+// Turn the results of the pivot query, with a row per combination of field values, into a row per
+// combination of non-pivot field values, with a column for each of the top PivotLimit values of the pivot field,
+// an (other) column adding up the rest, and a column with the row total.
+// Missing combinations are counted as zero.
+func (spec *RequestCountSpec) pivotResults(columns []string, rows [][]string) ([]string, [][]string) {
+	rowFields := len(spec.GroupByMetrics) - 1
+	pivotIndex, countIndex, rowRankIndex, columnRankIndex := rowFields, rowFields+1, rowFields+2, rowFields+3
+
+	// the rows are sorted by column rank within each row, but the top values may be missing from some of them
+	pivotRanks := make(map[string]int)
+	var pivotValues []string
+	hasOther := false
+	for _, row := range rows {
+		rank, _ := strconv.Atoi(row[columnRankIndex])
+		if rank > spec.PivotLimit {
+			hasOther = true
+		} else if _, found := pivotRanks[row[pivotIndex]]; !found {
+			pivotRanks[row[pivotIndex]] = rank
+			pivotValues = append(pivotValues, row[pivotIndex])
+		}
+	}
+	slices.SortFunc(pivotValues, func(a string, b string) int {
+		return pivotRanks[a] - pivotRanks[b]
+	})
+
+	pivotColumns := slices.Clone(pivotValues)
+	if hasOther {
+		pivotColumns = append(pivotColumns, OTHER_RESULTS)
+	}
+	resultColumns := slices.Clone(columns[:rowFields])
+	for _, value := range pivotColumns {
+		if value == "" {
+			value = "-"
+		}
+		resultColumns = append(resultColumns, value)
+	}
+	resultColumns = append(resultColumns, columns[countIndex])
+
+	// add up the counts of each row, the last one being the row total
+	var results [][]string
+	var counts [][]int
+	previousRank := ""
+	for _, row := range rows {
+		if row[rowRankIndex] != previousRank {
+			results = append(results, slices.Clone(row[:rowFields]))
+			counts = append(counts, make([]int, len(pivotColumns)+1))
+			previousRank = row[rowRankIndex]
+		}
+		rowCounts := counts[len(counts)-1]
+
+		column := len(pivotColumns) - 1
+		if _, found := pivotRanks[row[pivotIndex]]; found {
+			column = slices.Index(pivotValues, row[pivotIndex])
+		}
+		count, _ := strconv.Atoi(row[countIndex])
+		rowCounts[column] += count
+		rowCounts[len(rowCounts)-1] += count
+	}
+	for i, rowCounts := range counts {
+		for _, count := range rowCounts {
+			results[i] = append(results[i], strconv.Itoa(count))
+		}
+	}
+	return resultColumns, results
+}
+
+// Quote the given column names so they can be referenced in the queries wrapping the grouped results.
+func quoteColumns(columns []string) []string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = `"` + column + `"`
+	}
+	return quoted
+}
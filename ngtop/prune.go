@@ -0,0 +1,103 @@
+package ngtop
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// The times before which stored data should be deleted. Zero values mean the data is kept indefinitely.
+type RetentionCutoffs struct {
+	Logs   time.Time
+	Hourly time.Time
+	Daily  time.Time
+}
+
+// The amount of rows deleted from each table by a prune operation.
+type PruneResult struct {
+	Logs     int64
+	Hourly   int64
+	Daily    int64
+	Rejected int64
+}
+
+// Delete the log entries and rollup buckets older than the given cutoffs, then vacuum the database
+// to reclaim the disk space. Before deleting log entries, the rollups are refreshed to include them,
+// so queries over the pruned time ranges can still be resolved from the aggregated counts.
+// Dictionary values no longer referenced by the remaining log entries are deleted too, and so are the rejected lines
+// older than the log entries cutoff.
+// The log entries cutoff is truncated to the start of its day, so the rollup buckets are always computed
+// from complete days.
+// If the context is cancelled before the deletions are committed, they are rolled back.
+func (dbs *DBSession) Prune(ctx context.Context, cutoffs RetentionCutoffs) (*PruneResult, error) {
+	tx, err := dbs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PruneResult{}
+	if err := dbs.refreshRollups(tx, ""); err != nil {
+		return nil, errors.Join(err, rollback(tx))
+	}
+
+	tables := []struct {
+		name     string
+		column   string
+		cutoff   time.Time
+		truncate time.Duration
+		deleted  *int64
+		stateKey string
+	}{
+		{"access_logs", "time", cutoffs.Logs, 24 * time.Hour, &result.Logs, "access_logs_pruned_until"},
+		{"rollup_hourly", "bucket", cutoffs.Hourly, time.Hour, &result.Hourly, "rollup_hourly_pruned_until"},
+		{"rollup_daily", "bucket", cutoffs.Daily, 24 * time.Hour, &result.Daily, "rollup_daily_pruned_until"},
+		{"rejected_lines", "rejected_at", cutoffs.Logs, 24 * time.Hour, &result.Rejected, "rejected_lines_pruned_until"},
+	}
+	for _, table := range tables {
+		if table.cutoff.IsZero() {
+			continue
+		}
+		cutoff := table.cutoff.UTC().Truncate(table.truncate)
+
+		// never move the cutoff backwards, since the data before it is already gone
+		prunedUntil, err := getStateTime(tx, table.stateKey)
+		if err != nil {
+			return nil, errors.Join(err, rollback(tx))
+		}
+		if cutoff.Before(prunedUntil) {
+			cutoff = prunedUntil
+		}
+
+		query := fmt.Sprintf("DELETE FROM %s WHERE %s < ?", table.name, table.column)
+		log.Printf("query: %s %s\n", query, cutoff)
+		deleteResult, err := tx.Exec(query, cutoff.Format(DB_DATE_LAYOUT))
+		if err != nil {
+			return nil, errors.Join(err, rollback(tx))
+		}
+		*table.deleted, _ = deleteResult.RowsAffected()
+
+		if err := setState(tx, table.stateKey, cutoff.Format(DB_DATE_LAYOUT)); err != nil {
+			return nil, errors.Join(err, rollback(tx))
+		}
+	}
+
+	if result.Logs > 0 {
+		if err := dbs.dictionaries.deleteUnused(tx); err != nil {
+			return nil, errors.Join(err, rollback(tx))
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if result.Logs+result.Hourly+result.Daily+result.Rejected > 0 {
+		log.Println("vacuuming database")
+		if _, err := dbs.db.ExecContext(ctx, "VACUUM"); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
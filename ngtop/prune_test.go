@@ -0,0 +1,149 @@
+package ngtop
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrune(t *testing.T) {
+	dbFile, err := os.CreateTemp("", "ngtop.db")
+	assertEqual(t, err, nil)
+	defer os.Remove(dbFile.Name())
+
+	parser := NewParser(DEFAULT_LOG_FORMAT)
+	dbs, err := InitDB(dbFile.Name(), parser.Fields)
+	assertEqual(t, err, nil)
+	defer dbs.Close()
+
+	// insert an entry every 30 minutes over 10 days
+	start := time.Date(2024, time.July, 20, 0, 0, 0, 0, time.UTC)
+	paths := []string{"/", "/feed.xml", "/blog/"}
+	err = dbs.PrepareForInsert(context.Background())
+	assertEqual(t, err, nil)
+	for i := range 10 * 48 {
+		values, err := parser.ParseRecord(map[string]string{
+			"time_iso8601": start.Add(time.Duration(i) * 30 * time.Minute).Format("2006-01-02T15:04:05-07:00"),
+			"request":      fmt.Sprintf("GET %s HTTP/1.1", paths[i%len(paths)]),
+			"status":       "200",
+		})
+		assertEqual(t, err, nil)
+		err = dbs.AddLogEntry(values)
+		assertEqual(t, err, nil)
+	}
+	err = dbs.FinishUpdate(nil)
+	assertEqual(t, err, nil)
+
+	countSpec := func(since time.Time, until time.Time) *RequestCountSpec {
+		return &RequestCountSpec{TimeSince: since, TimeUntil: until, Limit: 10}
+	}
+	pathSpec := &RequestCountSpec{GroupByMetrics: []string{"path"}, TimeSince: start.Add(-time.Hour), TimeUntil: start.Add(20 * 24 * time.Hour), Limit: 10}
+	// every path has the same count, so compare them sorted
+	_, before, err := dbs.QueryTop(context.Background(), pathSpec)
+	assertEqual(t, err, nil)
+	slices.SortFunc(before, slices.Compare)
+
+	// keep the log entries of the last 3 days and the hourly rollups of the last 6, the cutoffs are truncated to the day
+	result, err := dbs.Prune(context.Background(), RetentionCutoffs{
+		Logs:   start.Add(7*24*time.Hour + 5*time.Hour),
+		Hourly: start.Add(4 * 24 * time.Hour),
+	})
+	assertEqual(t, err, nil)
+	assertEqual(t, result.Logs, int64(7*48))
+	// two distinct paths per hour
+	assertEqual(t, result.Hourly, int64(4*24*2))
+	assertEqual(t, result.Daily, int64(0))
+	assertEqual(t, len(queryColumn(t, dbs, "time")), 3*48)
+
+	// pruned ranges are resolved from the rollups
+	_, after, err := dbs.QueryTop(context.Background(), pathSpec)
+	assertEqual(t, err, nil)
+	slices.SortFunc(after, slices.Compare)
+	assertEqual(t, after, before)
+
+	_, rows, err := dbs.QueryTop(context.Background(), countSpec(start.Add(5*24*time.Hour), start.Add(6*24*time.Hour)))
+	assertEqual(t, err, nil)
+	assertEqual(t, rows, [][]string{{"48"}})
+
+	// only daily buckets are left for the first days, so the start of the range is approximated to the day
+	_, rows, err = dbs.QueryTop(context.Background(), countSpec(start.Add(24*time.Hour+12*time.Hour), start.Add(3*24*time.Hour)))
+	assertEqual(t, err, nil)
+	assertEqual(t, rows, [][]string{{"96"}})
+
+	// hourly buckets are used when available
+	_, rows, err = dbs.QueryTop(context.Background(), countSpec(start.Add(5*24*time.Hour+12*time.Hour), start.Add(6*24*time.Hour)))
+	assertEqual(t, err, nil)
+	assertEqual(t, rows, [][]string{{"24"}})
+
+	// fields that aren't in the rollups can't be counted over pruned ranges
+	ipSpec := &RequestCountSpec{GroupByMetrics: []string{"ip"}, TimeSince: start, TimeUntil: start.Add(20 * 24 * time.Hour), Limit: 10}
+	_, _, err = dbs.QueryTop(context.Background(), ipSpec)
+	assert(t, err != nil)
+	assert(t, strings.Contains(err.Error(), "before 2024-07-27 00:00:00 were pruned"))
+	ipSpec.TimeSince = start.Add(7 * 24 * time.Hour)
+	_, rows, err = dbs.QueryTop(context.Background(), ipSpec)
+	assertEqual(t, err, nil)
+	assertEqual(t, len(rows), 1)
+
+	// pruning again with older cutoffs doesn't delete anything
+	result, err = dbs.Prune(context.Background(), RetentionCutoffs{Logs: start, Hourly: start})
+	assertEqual(t, err, nil)
+	assertEqual(t, *result, PruneResult{})
+	_, after, err = dbs.QueryTop(context.Background(), pathSpec)
+	assertEqual(t, err, nil)
+	slices.SortFunc(after, slices.Compare)
+	assertEqual(t, after, before)
+}
+
+func TestUpdateAfterPrune(t *testing.T) {
+	dbFile, err := os.CreateTemp("", "ngtop.db")
+	assertEqual(t, err, nil)
+	defer os.Remove(dbFile.Name())
+	logFile, err := os.CreateTemp("", "access.log")
+	assertEqual(t, err, nil)
+	defer os.Remove(logFile.Name())
+	_, err = logFile.WriteString(`xx.xx.xx.xx - - [20/Jul/2024:00:00:28 +0000] "GET /feed HTTP/1.1" 301 169 "-" "Mozilla/5.0"
+xx.xx.xx.xx - - [20/Jul/2024:00:01:18 +0000] "GET /feed.xml HTTP/1.1" 200 9641 "-" "Mozilla/5.0"
+this has a different format
+xx.xx.xx.xx - - [21/Jul/2024:00:02:17 +0000] "GET / HTTP/1.1" 200 1120 "-" "Mozilla/5.0"
+`)
+	assertEqual(t, err, nil)
+
+	parser := NewParser(DEFAULT_LOG_FORMAT)
+	dbs, err := InitDB(dbFile.Name(), parser.Fields)
+	assertEqual(t, err, nil)
+	defer dbs.Close()
+
+	// load the log file and prune every entry, returning the amount of inserted entries
+	cutoffs := RetentionCutoffs{Logs: time.Date(2024, time.July, 23, 0, 0, 0, 0, time.UTC)}
+	update := func() (int, *PruneResult) {
+		until, err := dbs.PrepareForUpdate(context.Background())
+		assertEqual(t, err, nil)
+		inserted := 0
+		_, err = parser.Parse(context.Background(), []string{logFile.Name()}, until, func(values []any) error {
+			inserted++
+			return dbs.AddLogEntry(values)
+		}, func(rejected *RejectedLine) error {
+			return dbs.AddRejectedLine(rejected, time.Date(2024, time.July, 22, 0, 0, 0, 0, time.UTC))
+		})
+		assertEqual(t, dbs.FinishUpdate(err), nil)
+		result, err := dbs.Prune(context.Background(), cutoffs)
+		assertEqual(t, err, nil)
+		return inserted, result
+	}
+
+	inserted, result := update()
+	assertEqual(t, inserted, 3)
+	assertEqual(t, *result, PruneResult{Logs: 3, Rejected: 1})
+
+	// the pruned entries aren't loaded again
+	for range 2 {
+		inserted, result = update()
+		assertEqual(t, inserted, 0)
+		assertEqual(t, *result, PruneResult{})
+	}
+}
@@ -0,0 +1,170 @@
+package ngtop
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Recompute the derived fields of the stored log entries (e.g. `user_agent`, `os` or `path`) from the raw values
+// they are derived from (e.g. `user_agent_raw` or `request_raw`). This allows to pick up changes in the derivation
+// logic for old entries, or to populate derived fields that didn't exist when the entries were inserted.
+// Only the derived fields in `columns` are updated, or all of the parser's if it's empty.
+// When `since` or `until` are given, only the entries in that time window are updated.
+// Distinct raw values are processed in batches of `batchSize`, each in its own transaction.
+// Rollups are invalidated before the first batch, and won't be used by queries until they are refreshed on the next update.
+// Returns the amount of updated rows. If the context is cancelled, the current batch is rolled back,
+// but the previous ones are kept.
+func (dbs *DBSession) Reindex(ctx context.Context, parser *LogParser, columns []string, since *time.Time, until *time.Time, batchSize int) (int64, error) {
+	stored := make(map[string]bool)
+	for _, column := range dbs.columns {
+		stored[column] = true
+	}
+	requested := make(map[string]bool)
+	for _, column := range columns {
+		requested[column] = true
+	}
+
+	// when a field is both derived and directly extracted from the log format (e.g. `referer` from `$http_referer`),
+	// the direct value takes precedence, so the derived one is only used to fill the blanks
+	direct := make(map[string]bool)
+	for _, logvar := range parser.formatRegex.SubexpNames() {
+		if field, found := LOGVAR_TO_FIELD[logvar]; found {
+			direct[field.ColumnName] = true
+		}
+	}
+
+	var updatedCount int64
+	invalidated := false
+	for _, source := range parser.Fields {
+		if source.ParseDerivedFields == nil {
+			continue
+		}
+
+		var targets []string
+		for _, derived := range source.DerivedFields {
+			if stored[derived] && (len(requested) == 0 || requested[derived]) {
+				targets = append(targets, derived)
+			}
+		}
+		if len(targets) == 0 {
+			continue
+		}
+
+		// the rolled up counts may no longer match the entries, so they need to be recomputed.
+		// This is done before any batch is committed, so they aren't used if the reindex is interrupted
+		if !invalidated {
+			if err := dbs.invalidateRollups(); err != nil {
+				return updatedCount, err
+			}
+			invalidated = true
+		}
+
+		count, err := dbs.reindexSource(ctx, source, targets, direct, since, until, batchSize)
+		updatedCount += count
+		if err != nil {
+			return updatedCount, err
+		}
+	}
+	return updatedCount, nil
+}
+
+// Recompute the `targets` derived fields of the given `source` field, for each of its distinct stored values.
+func (dbs *DBSession) reindexSource(ctx context.Context, source *LogField, targets []string, direct map[string]bool, since *time.Time, until *time.Time, batchSize int) (int64, error) {
+	timeCondition := ""
+	timeArgs := []any{}
+	if since != nil {
+		timeCondition += " AND time > ?"
+		timeArgs = append(timeArgs, since.UTC())
+	}
+	if until != nil {
+		timeCondition += " AND time < ?"
+		timeArgs = append(timeArgs, until.UTC())
+	}
+
+	// load the values upfront to avoid reading and writing the table at the same time
+	query := fmt.Sprintf("SELECT DISTINCT %s FROM access_logs WHERE %s IS NOT NULL %s", dbs.dictionaries.valueExpression(source.ColumnName), source.ColumnName, timeCondition)
+	log.Printf("query: %s %s\n", query, timeArgs)
+	rows, err := dbs.db.QueryContext(ctx, query, timeArgs...)
+	if err != nil {
+		return 0, err
+	}
+	var rawValues []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		rawValues = append(rawValues, value)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	setExpressions := make([]string, len(targets))
+	for i, target := range targets {
+		if direct[target] {
+			setExpressions[i] = fmt.Sprintf("%s = CASE WHEN coalesce(%s, '') = '' THEN ? ELSE %s END", target, dbs.dictionaries.valueExpression(target), target)
+		} else {
+			setExpressions[i] = fmt.Sprintf("%s = ?", target)
+		}
+	}
+	update := fmt.Sprintf("UPDATE access_logs SET %s WHERE %s %s", strings.Join(setExpressions, ", "), dbs.dictionaries.condition(source.ColumnName, "=", false), timeCondition)
+	log.Printf("query: %s\n", update)
+
+	var updatedCount int64
+	for start := 0; start < len(rawValues); start += batchSize {
+		end := min(start+batchSize, len(rawValues))
+		count, err := dbs.updateBatch(ctx, update, rawValues[start:end], source, targets, timeArgs)
+		updatedCount += count
+		if err != nil {
+			return updatedCount, err
+		}
+		log.Printf("reindexed %d/%d distinct %s values\n", end, len(rawValues), source.ColumnName)
+	}
+	return updatedCount, nil
+}
+
+// Run the given update statement for each of the raw values in a single transaction.
+func (dbs *DBSession) updateBatch(ctx context.Context, update string, rawValues []string, source *LogField, targets []string, timeArgs []any) (int64, error) {
+	tx, err := dbs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	stmt, err := tx.Prepare(update)
+	if err != nil {
+		return 0, errors.Join(err, rollback(tx))
+	}
+	defer stmt.Close()
+	encoder := newDictionaryEncoder(tx, dbs.dictionaries)
+
+	var updatedCount int64
+	for _, rawValue := range rawValues {
+		derived := source.ParseDerivedFields(rawValue)
+		values := make([]any, len(targets))
+		for i, target := range targets {
+			// missing values are stored as empty strings, same as when inserting
+			values[i] = derived[target]
+		}
+		args, err := encoder.encodeValues(targets, values)
+		if err != nil {
+			return 0, errors.Join(err, rollback(tx))
+		}
+		args = append(args, rawValue)
+		args = append(args, timeArgs...)
+
+		var result sql.Result
+		if result, err = stmt.Exec(args...); err != nil {
+			return 0, errors.Join(err, rollback(tx))
+		}
+		count, _ := result.RowsAffected()
+		updatedCount += count
+	}
+	return updatedCount, tx.Commit()
+}
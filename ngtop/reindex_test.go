@@ -0,0 +1,86 @@
+package ngtop
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReindex(t *testing.T) {
+	dbFile, err := os.CreateTemp("", "ngtop.db")
+	assertEqual(t, err, nil)
+	defer os.Remove(dbFile.Name())
+
+	parser := NewParser(DEFAULT_LOG_FORMAT)
+	dbs, err := InitDB(dbFile.Name(), parser.Fields)
+	assertEqual(t, err, nil)
+	defer dbs.Close()
+
+	lines := []string{
+		`xx.xx.xx.xx - - [24/Jul/2024:00:00:28 +0000] "GET /feed HTTP/1.1" 301 169 "-" "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/109.0.0.0 Safari/537.36"`,
+		`xx.xx.xx.xx - - [24/Jul/2024:00:01:18 +0000] "GET /feed.xml?ref=example.com HTTP/1.1" 200 9641 "https://olano.dev/feed.xml" "FreshRSS/1.24.0 (Linux; https://freshrss.org)"`,
+		`xx.xx.xx.xx - - [24/Jul/2024:00:02:17 +0000] "GET /?ref=example.com HTTP/1.1" 200 1120 "-" "FreshRSS/1.24.0 (Linux; https://freshrss.org)"`,
+	}
+	err = dbs.PrepareForInsert(context.Background())
+	assertEqual(t, err, nil)
+	for _, line := range lines {
+		values, err := parser.ParseRecord(map[string]string{"message": line})
+		assertEqual(t, err, nil)
+		err = dbs.AddLogEntry(values)
+		assertEqual(t, err, nil)
+	}
+	err = dbs.FinishUpdate(nil)
+	assertEqual(t, err, nil)
+
+	// an interrupted reindex invalidates the rollups, even if no batch was committed
+	err = setState(dbs.db, "rollup_hourly_refreshed_until", time.Date(2024, time.July, 24, 0, 0, 0, 0, time.UTC))
+	assertEqual(t, err, nil)
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = dbs.Reindex(cancelled, parser, nil, nil, nil, 100)
+	assert(t, err != nil)
+	refreshedUntil, err := getStateTime(dbs.db, "rollup_hourly_refreshed_until")
+	assertEqual(t, err, nil)
+	assert(t, refreshedUntil.IsZero())
+
+	// simulate stale derived values
+	_, err = dbs.db.Exec(`INSERT INTO dict_os (value) VALUES ('stale');
+		UPDATE access_logs SET os = (SELECT id FROM dict_os WHERE value = 'stale'), ua_type = NULL, method = NULL`)
+	assertEqual(t, err, nil)
+	_, err = dbs.db.Exec("UPDATE access_logs SET referer = NULL WHERE path IN (SELECT id FROM dict_path WHERE value = '/')")
+	assertEqual(t, err, nil)
+
+	// only reindex os in the last minute
+	since := time.Date(2024, time.July, 24, 0, 1, 0, 0, time.UTC)
+	count, err := dbs.Reindex(context.Background(), parser, []string{"os"}, &since, nil, 1)
+	assertEqual(t, err, nil)
+	assertEqual(t, count, int64(2))
+	assertEqual(t, queryColumn(t, dbs, "os"), []string{"stale", "Linux", "Linux"})
+	assertEqual(t, queryColumn(t, dbs, "ua_type"), []string{"", "", ""})
+
+	// reindex everything
+	count, err = dbs.Reindex(context.Background(), parser, nil, nil, nil, 100)
+	assertEqual(t, err, nil)
+	assertEqual(t, queryColumn(t, dbs, "os"), []string{"Windows", "Linux", "Linux"})
+	assertEqual(t, queryColumn(t, dbs, "ua_type"), []string{"desktop", "bot", "bot"})
+	assertEqual(t, queryColumn(t, dbs, "method"), []string{"GET", "GET", "GET"})
+	// referer is only derived from the request when the direct value is missing
+	assertEqual(t, queryColumn(t, dbs, "referer"), []string{"", "olano.dev/feed.xml", "example.com"})
+}
+
+func queryColumn(t *testing.T, dbs *DBSession, column string) []string {
+	t.Helper()
+	rows, err := dbs.db.Query("SELECT coalesce(" + dbs.dictionaries.valueExpression(column) + ", '') FROM access_logs ORDER BY time")
+	assertEqual(t, err, nil)
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		err := rows.Scan(&value)
+		assertEqual(t, err, nil)
+		values = append(values, value)
+	}
+	return values
+}
@@ -0,0 +1,285 @@
+package ngtop
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A table with request counts pre-aggregated by time bucket and ROLLUP_DIMENSIONS.
+type rollup struct {
+	table string
+	// the strftime format to truncate a log time to the start of its bucket
+	bucketFormat string
+	// the length of the buckets
+	duration time.Duration
+}
+
+// The available rollups, from the coarsest to the finest grained.
+var ROLLUPS = []rollup{
+	{table: "rollup_daily", bucketFormat: "%Y-%m-%d 00:00:00+00:00", duration: 24 * time.Hour},
+	{table: "rollup_hourly", bucketFormat: "%Y-%m-%d %H:00:00+00:00", duration: time.Hour},
+}
+
+// The columns the rollups are aggregated by. Queries that group or filter by other fields
+// (typically ones with too many distinct values to be worth aggregating, like `ip`) always read the log entries.
+var ROLLUP_DIMENSIONS = []string{"method", "path", "status", "referer", "user_agent", "os", "device", "ua_type", "host"}
+
+// A time range of a query, resolved from a single table.
+type querySegment struct {
+	// either access_logs or one of the rollup tables
+	table string
+	since time.Time
+	until time.Time
+	// whether entries exactly at the `since` time should be included.
+	// The query window excludes them, but segments starting at a bucket boundary need to include them.
+	sinceInclusive bool
+}
+
+// Recompute the counts of the rollup buckets starting from the one that contains `updatedSince`.
+// Rollups are refreshed from the oldest of `updatedSince` and the time of their previous refresh,
+// or rebuilt entirely if they were never refreshed before.
+func (dbs *DBSession) refreshRollups(tx *sql.Tx, updatedSince string) error {
+	var latestTime sql.NullString
+	if err := tx.QueryRow("SELECT max(time) FROM access_logs").Scan(&latestTime); err != nil {
+		return err
+	}
+
+	// dimensions missing from the table are stored as null
+	dimensions := make([]string, len(ROLLUP_DIMENSIONS))
+	for i, dimension := range ROLLUP_DIMENSIONS {
+		if dbs.tableColumns[dimension] {
+			dimensions[i] = dbs.dictionaries.valueExpression(dimension)
+		} else {
+			dimensions[i] = "NULL"
+		}
+	}
+	groupByExpression := "GROUP BY 1"
+	for i := range len(dimensions) {
+		groupByExpression += fmt.Sprintf(", %d", i+2)
+	}
+
+	// the buckets of pruned log entries can't be recomputed, so they are always preserved
+	prunedUntil, err := getState(tx, "access_logs_pruned_until")
+	if err != nil {
+		return err
+	}
+
+	for _, rollup := range ROLLUPS {
+		refreshSince := updatedSince
+		refreshedUntil, err := getState(tx, rollup.table+"_refreshed_until")
+		if err != nil {
+			return err
+		}
+		if refreshedUntil == "" {
+			// never refreshed, rebuild entirely
+			refreshSince = ""
+		} else if refreshSince == "" || refreshedUntil < refreshSince {
+			refreshSince = refreshedUntil
+		}
+		if refreshSince == "" || refreshSince < prunedUntil {
+			refreshSince = prunedUntil
+		}
+
+		var deleteCondition, insertCondition string
+		args := []any{}
+		if refreshSince != "" {
+			since, err := time.Parse(DB_DATE_LAYOUT, refreshSince)
+			if err != nil {
+				return err
+			}
+			deleteCondition = "WHERE bucket >= ?"
+			insertCondition = "WHERE time >= ?"
+			args = append(args, since.UTC().Truncate(rollup.duration).Format(DB_DATE_LAYOUT))
+		}
+
+		deleteQuery := fmt.Sprintf("DELETE FROM %s %s", rollup.table, deleteCondition)
+		insertQuery := fmt.Sprintf(
+			"INSERT INTO %s (bucket, %s, requests) SELECT strftime('%s', time), %s, count(1) FROM access_logs %s %s",
+			rollup.table,
+			strings.Join(ROLLUP_DIMENSIONS, ", "),
+			rollup.bucketFormat,
+			strings.Join(dimensions, ", "),
+			insertCondition,
+			groupByExpression,
+		)
+		log.Printf("query: %s %s\n", deleteQuery, args)
+		if _, err := tx.Exec(deleteQuery, args...); err != nil {
+			return err
+		}
+		log.Printf("query: %s %s\n", insertQuery, args)
+		if _, err := tx.Exec(insertQuery, args...); err != nil {
+			return err
+		}
+
+		if err := setState(tx, rollup.table+"_refreshed_until", latestTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Discard the state of the rollup refreshes, so they are ignored by queries until they are recomputed.
+// This is necessary when the stored log entries are modified.
+func (dbs *DBSession) invalidateRollups() error {
+	for _, rollup := range ROLLUPS {
+		if err := setState(dbs.db, rollup.table+"_refreshed_until", nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Split the query time window into segments, so the largest possible parts of it are resolved from
+// the rollup tables, and the rest from the log entries.
+// Rollups are only used if every field in the query is one of ROLLUP_DIMENSIONS,
+// and only for the buckets that were completely refreshed.
+func (dbs *DBSession) planQuery(spec *RequestCountSpec) ([]querySegment, error) {
+	window := querySegment{table: "access_logs", since: spec.TimeSince, until: spec.TimeUntil}
+	if !window.since.Before(window.until) {
+		return []querySegment{window}, nil
+	}
+
+	queryColumns := slices.Clone(spec.GroupByMetrics)
+	for column := range spec.Where {
+		queryColumns = append(queryColumns, column)
+	}
+	for _, column := range queryColumns {
+		if !slices.Contains(ROLLUP_DIMENSIONS, column) || !dbs.tableColumns[column] {
+			// without rollups, the counts of the pruned part of the window would be silently missing
+			logsSince, err := getStateTime(dbs.db, "access_logs_pruned_until")
+			if err != nil {
+				return nil, err
+			}
+			if window.since.Before(logsSince) {
+				return nil, fmt.Errorf("the log entries before %s were pruned, and %s can't be counted from the rollups. Query a time window after that", logsSince.UTC().Format(time.DateTime), column)
+			}
+			return []querySegment{window}, nil
+		}
+	}
+
+	tables := []string{"access_logs"}
+	for _, rollup := range ROLLUPS {
+		tables = append(tables, rollup.table)
+	}
+	refreshedUntil := make(map[string]time.Time)
+	prunedUntil := make(map[string]time.Time)
+	for _, table := range tables {
+		var err error
+		if refreshedUntil[table], err = getStateTime(dbs.db, table+"_refreshed_until"); err != nil {
+			return nil, err
+		}
+		if prunedUntil[table], err = getStateTime(dbs.db, table+"_pruned_until"); err != nil {
+			return nil, err
+		}
+	}
+
+	// the part of the window with pruned log entries can only be resolved from the rollups
+	var segments []querySegment
+	if logsSince := prunedUntil["access_logs"]; window.since.Before(logsSince) {
+		segments = prunedSegments(window.since, minTime(window.until, logsSince), prunedUntil)
+		window.since = logsSince
+		window.sinceInclusive = true
+	}
+
+	segments = append(segments, splitSegment(window, ROLLUPS, refreshedUntil)...)
+	log.Printf("query plan: %v\n", segments)
+	return segments, nil
+}
+
+// Resolve a time range without log entries from the finest-grained rollup available for each part of it.
+// The start of the range is extended to the start of its bucket, so the results are an approximation.
+func prunedSegments(since time.Time, until time.Time, prunedUntil map[string]time.Time) []querySegment {
+	var segments []querySegment
+	for i := len(ROLLUPS) - 1; i >= 0 && since.Before(until); i-- {
+		rollup := ROLLUPS[i]
+		bucketsSince := since
+		if rollupSince := prunedUntil[rollup.table]; rollupSince.After(bucketsSince) {
+			bucketsSince = rollupSince
+		}
+		bucketsSince = bucketsSince.UTC().Truncate(rollup.duration)
+		if bucketsSince.Before(until) {
+			segment := querySegment{table: rollup.table, since: bucketsSince, until: until, sinceInclusive: true}
+			segments = append([]querySegment{segment}, segments...)
+			until = bucketsSince
+		}
+	}
+	return segments
+}
+
+func minTime(a time.Time, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// An interface satisfied by both sql.DB and sql.Tx, to read and write state in or outside transactions.
+type execQuerier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// Get the value of a key from the db_state table, or an empty string if it isn't set.
+func getState(db execQuerier, key string) (string, error) {
+	var value sql.NullString
+	err := db.QueryRow("SELECT value FROM db_state WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value.String, err
+}
+
+// Get the time value of a key from the db_state table, or the zero time if it isn't set.
+func getStateTime(db execQuerier, key string) (time.Time, error) {
+	value, err := getState(db, key)
+	if err != nil || value == "" {
+		return time.Time{}, err
+	}
+	return time.Parse(DB_DATE_LAYOUT, value)
+}
+
+// Set the value of a key in the db_state table.
+func setState(db execQuerier, key string, value any) error {
+	_, err := db.Exec("INSERT OR REPLACE INTO db_state (key, value) VALUES (?, ?)", key, value)
+	return err
+}
+
+// Recursively split the given log entries segment into the full buckets covered by the first rollup,
+// and the segments before and after them, which are in turn split with the next rollups.
+func splitSegment(segment querySegment, rollups []rollup, refreshedUntil map[string]time.Time) []querySegment {
+	if !segment.since.Before(segment.until) {
+		return nil
+	}
+	if len(rollups) == 0 {
+		return []querySegment{segment}
+	}
+
+	rollup := rollups[0]
+	bucketsSince := segment.since.UTC().Truncate(rollup.duration)
+	if bucketsSince.Before(segment.since) || (bucketsSince.Equal(segment.since) && !segment.sinceInclusive) {
+		bucketsSince = bucketsSince.Add(rollup.duration)
+	}
+	// the bucket of the last refresh may be incomplete, so it can't be used
+	bucketsUntil := segment.until.UTC().Truncate(rollup.duration)
+	if rollupUntil := refreshedUntil[rollup.table]; rollupUntil.IsZero() {
+		return splitSegment(segment, rollups[1:], refreshedUntil)
+	} else if rollupUntil = rollupUntil.UTC().Truncate(rollup.duration); rollupUntil.Before(bucketsUntil) {
+		bucketsUntil = rollupUntil
+	}
+	if !bucketsSince.Before(bucketsUntil) {
+		return splitSegment(segment, rollups[1:], refreshedUntil)
+	}
+
+	before := querySegment{table: segment.table, since: segment.since, until: bucketsSince, sinceInclusive: segment.sinceInclusive}
+	after := querySegment{table: segment.table, since: bucketsUntil, until: segment.until, sinceInclusive: true}
+	buckets := querySegment{table: rollup.table, since: bucketsSince, until: bucketsUntil, sinceInclusive: true}
+
+	segments := splitSegment(before, rollups[1:], refreshedUntil)
+	segments = append(segments, buckets)
+	return append(segments, splitSegment(after, rollups[1:], refreshedUntil)...)
+}
@@ -0,0 +1,153 @@
+package ngtop
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRollupQueries(t *testing.T) {
+	dbFile, err := os.CreateTemp("", "ngtop.db")
+	assertEqual(t, err, nil)
+	defer os.Remove(dbFile.Name())
+
+	parser := NewParser(DEFAULT_LOG_FORMAT)
+	dbs, err := InitDB(dbFile.Name(), parser.Fields)
+	assertEqual(t, err, nil)
+	defer dbs.Close()
+	dbs.EnableRollups()
+
+	// insert entries every 17 minutes over 4 days, in two batches
+	start := time.Date(2024, time.July, 20, 0, 0, 0, 0, time.UTC)
+	paths := []string{"/", "/feed.xml", "/blog/", "/about"}
+	statuses := []string{"200", "200", "301"}
+	for batch := range 2 {
+		err = dbs.PrepareForInsert(context.Background())
+		assertEqual(t, err, nil)
+		for i := batch * 200; i < (batch+1)*200 && i < 340; i++ {
+			values, err := parser.ParseRecord(map[string]string{
+				"time_iso8601": start.Add(time.Duration(i) * 17 * time.Minute).Format("2006-01-02T15:04:05-07:00"),
+				"request":      fmt.Sprintf("GET %s HTTP/1.1", paths[i%len(paths)]),
+				"status":       statuses[i%len(statuses)],
+			})
+			assertEqual(t, err, nil)
+			err = dbs.AddLogEntry(values)
+			assertEqual(t, err, nil)
+		}
+		err = dbs.FinishUpdate(nil)
+		assertEqual(t, err, nil)
+	}
+
+	specs := []*RequestCountSpec{
+		// unaligned window spanning several days
+		{
+			TimeSince: start.Add(5*time.Hour + 13*time.Minute),
+			TimeUntil: start.Add(2*24*time.Hour + 7*time.Hour + 41*time.Minute),
+			Limit:     10,
+		},
+		{
+			GroupByMetrics: []string{"path"},
+			TimeSince:      start.Add(-time.Hour),
+			TimeUntil:      start.Add(5 * 24 * time.Hour),
+			Limit:          10,
+		},
+		{
+			GroupByMetrics: []string{"path", "status"},
+			TimeSince:      start.Add(24 * time.Hour),
+			TimeUntil:      start.Add(3 * 24 * time.Hour),
+			Limit:          10,
+			Where:          map[string][]string{"path": {"/blog%", "/"}, "status": {"!301"}},
+		},
+		{
+			GroupByMetrics: []string{"status", "path"},
+			TimeSince:      start.Add(3 * time.Hour),
+			TimeUntil:      start.Add(4 * 24 * time.Hour),
+			SortBy:         "path",
+			Ascending:      true,
+			Limit:          3,
+			Offset:         2,
+			MinCount:       25,
+			MaxCount:       30,
+		},
+		{
+			GroupByMetrics: []string{"status", "path"},
+			PerMetrics:     []string{"status"},
+			TimeSince:      start.Add(3 * time.Hour),
+			TimeUntil:      start.Add(4 * 24 * time.Hour),
+			Limit:          10,
+			GroupLimit:     1,
+		},
+		{
+			GroupByMetrics: []string{"path", "status"},
+			PivotMetric:    "status",
+			TimeSince:      start.Add(3 * time.Hour),
+			TimeUntil:      start.Add(4 * 24 * time.Hour),
+			Limit:          10,
+			PivotLimit:     1,
+		},
+		// less than an hour
+		{
+			TimeSince: start.Add(20 * time.Minute),
+			TimeUntil: start.Add(50 * time.Minute),
+			Limit:     10,
+		},
+	}
+
+	for _, spec := range specs {
+		segments, err := dbs.planQuery(spec)
+		assertEqual(t, err, nil)
+
+		// rows with the same count may come in different order, so compare them sorted
+		_, rows, err := dbs.QueryTop(context.Background(), spec)
+		assertEqual(t, err, nil)
+		expected := queryEntries(t, dbs, spec)
+		slices.SortFunc(rows, slices.Compare)
+		slices.SortFunc(expected, slices.Compare)
+		assertEqual(t, rows, expected)
+		if spec.TimeUntil.Sub(spec.TimeSince) > 2*time.Hour {
+			assert(t, len(segments) > 1)
+		}
+	}
+
+	// fields that aren't rolled up always read the log entries
+	spec := &RequestCountSpec{
+		GroupByMetrics: []string{"ip"},
+		TimeSince:      start,
+		TimeUntil:      start.Add(5 * 24 * time.Hour),
+		Limit:          10,
+	}
+	segments, err := dbs.planQuery(spec)
+	assertEqual(t, err, nil)
+	assertEqual(t, len(segments), 1)
+	assertEqual(t, segments[0].table, "access_logs")
+}
+
+// Run the spec query directly against the log entries table.
+func queryEntries(t *testing.T, dbs *DBSession, spec *RequestCountSpec) [][]string {
+	t.Helper()
+	query, args := spec.buildQuery([]querySegment{{table: "access_logs", since: spec.TimeSince, until: spec.TimeUntil}}, dbs.dictionaries)
+	rows, err := dbs.db.Query(query, args...)
+	assertEqual(t, err, nil)
+	defer rows.Close()
+	columns, err := rows.Columns()
+	assertEqual(t, err, nil)
+
+	var results [][]string
+	for rows.Next() {
+		values := make([]any, len(columns))
+		strValues := make([]string, len(columns))
+		for i := range values {
+			values[i] = &strValues[i]
+		}
+		err := rows.Scan(values...)
+		assertEqual(t, err, nil)
+		results = append(results, strValues)
+	}
+	if spec.PivotMetric != "" {
+		_, results = spec.pivotResults(columns, results)
+	}
+	return results
+}
@@ -0,0 +1,285 @@
+package ngtop
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+)
+
+// A schema change, applied inside a transaction.
+type migration func(tx *sql.Tx) error
+
+// The ordered list of schema changes. The amount of migrations applied to a database is stored as its version
+// in the schema_version table, so on each run only the ones not seen before are applied.
+// New migrations should always be appended at the end of the list, and existing ones should never be changed.
+//
+// The columns of the access_logs table depend on the log format, so they aren't created by migrations
+// but added on demand by syncColumns.
+var MIGRATIONS = []migration{
+	// 1. base log entries table. It may already exist if the db was created before versioning was introduced.
+	execMigration(`
+		CREATE TABLE IF NOT EXISTS access_logs (
+			id 		INTEGER NOT NULL PRIMARY KEY,
+			time 	TIMESTAMP NOT NULL,
+			created TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`),
+
+	// 2. pre-aggregated request counts for long time ranges, and a key-value table to track their state
+	execMigration(
+		rollupTableSQL("rollup_hourly"),
+		rollupTableSQL("rollup_daily"),
+		`CREATE TABLE db_state (
+			key 	TEXT NOT NULL PRIMARY KEY,
+			value 	TEXT
+		);`),
+
+	// 3. move the repeated strings of existing log entries to dictionary tables, see `dictionaries`
+	encodeColumnsMigration("request_raw", "user_agent_raw", "referer", "path", "host", "method", "user_agent", "os", "device", "ua_url", "ua_type"),
+
+	// 4. summary of the log files read by the last update, see `FileStats`
+	execMigration(`
+		CREATE TABLE ingested_files (
+			path 			TEXT NOT NULL,
+			lines 			INTEGER NOT NULL,
+			processed 		INTEGER NOT NULL,
+			skipped 		INTEGER NOT NULL,
+			skipped_samples TEXT,
+			ingested_at 	TIMESTAMP NOT NULL
+		);`),
+
+	// 5. log entries that couldn't be parsed, see `RejectedLine`.
+	// Files are read again on every update, so the same line may be rejected more than once
+	execMigration(`
+		CREATE TABLE rejected_lines (
+			id 			INTEGER NOT NULL PRIMARY KEY,
+			source 		TEXT NOT NULL,
+			line_number INTEGER NOT NULL,
+			line 		TEXT NOT NULL,
+			reason 		TEXT NOT NULL,
+			rejected_at TIMESTAMP NOT NULL,
+			UNIQUE (source, line_number, line)
+		);`),
+
+	// 6. log times used to be stored with the offset of the log they came from, but they are compared as strings,
+	// so they are normalized to UTC
+	execMigration(`UPDATE access_logs SET time = strftime('%Y-%m-%d %H:%M:%S+00:00', time) WHERE time NOT LIKE '%+00:00'`),
+}
+
+// Returns the statements to create a rollup table with the given name.
+// See ROLLUP_DIMENSIONS.
+func rollupTableSQL(table string) string {
+	return fmt.Sprintf(`
+		CREATE TABLE %s (
+			bucket 		TIMESTAMP NOT NULL,
+			method 		TEXT COLLATE NOCASE,
+			path 		TEXT,
+			status 		INTEGER,
+			referer 	TEXT COLLATE NOCASE,
+			user_agent 	TEXT COLLATE NOCASE,
+			os 			TEXT COLLATE NOCASE,
+			device 		TEXT COLLATE NOCASE,
+			ua_type 	TEXT COLLATE NOCASE,
+			host 		TEXT,
+			requests 	INTEGER NOT NULL
+		);
+		CREATE INDEX %s_bucket ON %s(bucket);`, table, table, table)
+}
+
+// Returns a migration that runs the given SQL statements.
+func execMigration(statements ...string) migration {
+	return func(tx *sql.Tx) error {
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Returns a migration that converts the given access_logs columns, if they exist, from storing the values
+// as text to storing dictionary ids.
+func encodeColumnsMigration(columns ...string) migration {
+	return func(tx *sql.Tx) error {
+		existing, err := tableColumns(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, column := range columns {
+			if !existing[column] {
+				continue
+			}
+			// columns can't be dropped while indexed, syncColumns will create the index again
+			err := execMigration(
+				fmt.Sprintf("DROP INDEX IF EXISTS access_logs_%s", column),
+				dictionaryTableSQL(column, COLUMN_NAME_TO_FIELD[column].ColumnSpec),
+				fmt.Sprintf("INSERT OR IGNORE INTO dict_%s (value) SELECT DISTINCT %s FROM access_logs WHERE %s IS NOT NULL", column, column, column),
+				fmt.Sprintf("ALTER TABLE access_logs ADD COLUMN %s_id INTEGER", column),
+				fmt.Sprintf("UPDATE access_logs SET %s_id = (SELECT id FROM dict_%s WHERE value = access_logs.%s)", column, column, column),
+				fmt.Sprintf("ALTER TABLE access_logs DROP COLUMN %s", column),
+				fmt.Sprintf("ALTER TABLE access_logs RENAME COLUMN %s_id TO %s", column, column),
+			)(tx)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Bring the database schema to the latest version by applying the pending migrations, each on its own transaction.
+// Fails if the database was created by a newer version of the program, which may have changed the schema
+// in ways this one doesn't understand.
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL);"); err != nil {
+		return err
+	}
+
+	var version int
+	if err := db.QueryRow("SELECT coalesce(max(version), 0) FROM schema_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(MIGRATIONS) {
+		return fmt.Errorf("the database schema version is %d but this version of ngtop only supports up to %d, it was probably created by a newer ngtop. Upgrade ngtop or use a different NGTOP_DB", version, len(MIGRATIONS))
+	}
+
+	applied := false
+	for i := version; i < len(MIGRATIONS); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		// another process may have applied the migration while this one waited for the transaction
+		var currentVersion int
+		if err := tx.QueryRow("SELECT coalesce(max(version), 0) FROM schema_version").Scan(&currentVersion); err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+		if currentVersion > i {
+			if err := tx.Rollback(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		log.Printf("applying schema migration %d\n", i+1)
+		if err := MIGRATIONS[i](tx); err != nil {
+			return errors.Join(fmt.Errorf("schema migration %d failed: %w", i+1, err), tx.Rollback())
+		}
+		if _, err := tx.Exec("DELETE FROM schema_version"); err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+		if _, err := tx.Exec("INSERT INTO schema_version (version) VALUES (?)", i+1); err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		applied = true
+	}
+
+	// migrations may rewrite tables, so reclaim the space they freed
+	if applied {
+		log.Println("vacuuming database")
+		if _, err := db.Exec("VACUUM"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fail if the schema of the database isn't at the latest version.
+func checkSchemaVersion(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("SELECT coalesce(max(version), 0) FROM schema_version").Scan(&version); err != nil {
+		return fmt.Errorf("can't read the database schema version: %w", err)
+	}
+	if version > len(MIGRATIONS) {
+		return fmt.Errorf("the database schema version is %d but this version of ngtop only supports up to %d, it was probably created by a newer ngtop", version, len(MIGRATIONS))
+	} else if version < len(MIGRATIONS) {
+		return fmt.Errorf("the database schema version is %d but this version of ngtop requires %d, it needs to be opened once in write mode to be migrated", version, len(MIGRATIONS))
+	}
+	return nil
+}
+
+// Alter the access_logs table to include a column for each of the given fields, if it doesn't have one already,
+// and create the indexes of the ones flagged as Indexed.
+// Returns the names of all the columns in the table, which may include some not present in `fields`,
+// e.g. if the table was created with a different log format.
+// Dictionary fields are stored as ids, referencing a dictionary table that is created along with the column.
+func syncColumns(db *sql.DB, fields []*LogField) (map[string]bool, error) {
+	existing, err := tableColumns(db)
+	if err != nil {
+		return nil, err
+	}
+	if slices.ContainsFunc(fields, func(field *LogField) bool { return !existing[field.ColumnName] }) {
+		if existing, err = addColumns(db, fields); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, field := range fields {
+		if field.Indexed {
+			query := fmt.Sprintf("CREATE INDEX IF NOT EXISTS access_logs_%s ON access_logs(%s)", field.ColumnName, field.ColumnName)
+			if _, err := db.Exec(query); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return existing, nil
+}
+
+// Add the columns of the given fields missing from the access_logs table, in a single transaction.
+// The columns are checked again within the transaction, since another process may have added them
+// while this one waited for it. Returns the names of all the columns in the table.
+func addColumns(db *sql.DB, fields []*LogField) (map[string]bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	existing, err := tableColumns(tx)
+	if err != nil {
+		return nil, errors.Join(err, tx.Rollback())
+	}
+
+	for _, field := range fields {
+		if existing[field.ColumnName] {
+			continue
+		}
+		columnSpec := field.ColumnSpec
+		if field.Dictionary {
+			columnSpec = "INTEGER"
+			if _, err := tx.Exec(dictionaryTableSQL(field.ColumnName, field.ColumnSpec)); err != nil {
+				return nil, errors.Join(err, tx.Rollback())
+			}
+		}
+		query := fmt.Sprintf("ALTER TABLE access_logs ADD COLUMN %s %s", field.ColumnName, columnSpec)
+		log.Printf("query: %s\n", query)
+		if _, err := tx.Exec(query); err != nil {
+			return nil, errors.Join(err, tx.Rollback())
+		}
+		existing[field.ColumnName] = true
+	}
+	return existing, tx.Commit()
+}
+
+// Returns the names of the columns of the access_logs table.
+func tableColumns(db execQuerier) (map[string]bool, error) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info('access_logs')")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
@@ -0,0 +1,105 @@
+package ngtop
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMigrations(t *testing.T) {
+	dbFile, err := os.CreateTemp("", "ngtop.db")
+	assertEqual(t, err, nil)
+	defer os.Remove(dbFile.Name())
+
+	parser := NewParser(DEFAULT_LOG_FORMAT)
+	dbs, err := InitDB(dbFile.Name(), parser.Fields)
+	assertEqual(t, err, nil)
+
+	var version int
+	err = dbs.db.QueryRow("SELECT version FROM schema_version").Scan(&version)
+	assertEqual(t, err, nil)
+	assertEqual(t, version, len(MIGRATIONS))
+	dbs.Close()
+
+	// opening again is a no-op
+	dbs, err = InitDB(dbFile.Name(), parser.Fields)
+	assertEqual(t, err, nil)
+	dbs.Close()
+
+	// simulate a db created by a future version
+	db, err := sql.Open("sqlite3", dbFile.Name())
+	assertEqual(t, err, nil)
+	_, err = db.Exec("UPDATE schema_version SET version = ?", len(MIGRATIONS)+1)
+	assertEqual(t, err, nil)
+	db.Close()
+
+	_, err = InitDB(dbFile.Name(), parser.Fields)
+	assert(t, err != nil)
+	assert(t, strings.Contains(err.Error(), "newer ngtop"))
+}
+
+func TestMigrateLegacyDB(t *testing.T) {
+	dbFile, err := os.CreateTemp("", "ngtop.db")
+	assertEqual(t, err, nil)
+	defer os.Remove(dbFile.Name())
+
+	// a table as created before schema versioning, with a single entry
+	db, err := sql.Open("sqlite3", dbFile.Name())
+	assertEqual(t, err, nil)
+	_, err = db.Exec(`CREATE TABLE access_logs (
+		id INTEGER NOT NULL PRIMARY KEY,
+		time TIMESTAMP NOT NULL,
+		path TEXT,
+		created TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	INSERT INTO access_logs (time, path) VALUES ('2024-07-24 00:00:28+00:00', '/feed');
+	INSERT INTO access_logs (time, path) VALUES ('2024-07-24 02:00:30+02:00', '/feed');`)
+	assertEqual(t, err, nil)
+	db.Close()
+
+	parser := NewParser(DEFAULT_LOG_FORMAT)
+	dbs, err := InitDB(dbFile.Name(), parser.Fields)
+	assertEqual(t, err, nil)
+	defer dbs.Close()
+
+	// previous data is preserved, encoded in its dictionary, and new columns can be queried
+	assert(t, dbs.dictionaries["path"])
+	var count int
+	err = dbs.db.QueryRow("SELECT count(*) FROM access_logs WHERE path IN (SELECT id FROM dict_path WHERE value = '/feed') AND user_agent IS NULL").Scan(&count)
+	assertEqual(t, err, nil)
+	assertEqual(t, count, 2)
+
+	// times are normalized to UTC
+	assertEqual(t, queryColumn(t, dbs, "CAST(time AS TEXT)"), []string{"2024-07-24 00:00:28+00:00", "2024-07-24 00:00:30+00:00"})
+
+	_, rows, err := dbs.QueryTop(context.Background(), &RequestCountSpec{
+		GroupByMetrics: []string{"path"},
+		TimeSince:      time.Date(2024, time.July, 24, 0, 0, 0, 0, time.UTC),
+		TimeUntil:      time.Date(2024, time.July, 25, 0, 0, 0, 0, time.UTC),
+		Limit:          5,
+	})
+	assertEqual(t, err, nil)
+	assertEqual(t, rows, [][]string{{"/feed", "2"}})
+}
+
+func TestDynamicColumnNames(t *testing.T) {
+	dbFile, err := os.CreateTemp("", "ngtop.db")
+	assertEqual(t, err, nil)
+	defer os.Remove(dbFile.Name())
+
+	// regex captures can't be used as column names, so they are matched but not stored
+	parser := NewParser(`$remote_addr [$time_iso8601] $1 $scheme`)
+	assert(t, RegisterDynamicField("1") == nil)
+	dbs, err := InitDB(dbFile.Name(), parser.Fields)
+	assertEqual(t, err, nil)
+	defer dbs.Close()
+	assert(t, dbs.tableColumns["scheme"])
+	assert(t, !dbs.tableColumns["1"])
+
+	values, err := parser.ParseRecord(map[string]string{"message": "xx.xx.xx.xx [2024-07-24T00:00:49+00:00] match https"})
+	assertEqual(t, err, nil)
+	assertEqual(t, len(values), len(parser.Fields))
+}
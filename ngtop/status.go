@@ -0,0 +1,77 @@
+package ngtop
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strings"
+	"time"
+)
+
+// A summary of the contents of the database.
+type DBStatus struct {
+	// the size of the database file, including its write-ahead log, in bytes
+	Size    int64
+	Entries int64
+	// the times of the oldest and most recent log entries, nil if there are none
+	FirstTime *time.Time
+	LastTime  *time.Time
+	// the log files read by the last update and when it happened, nil if there wasn't any
+	IngestedAt    *time.Time
+	IngestedFiles []*FileStats
+}
+
+// Collect a summary of the database contents.
+func (dbs *DBSession) Status(ctx context.Context) (*DBStatus, error) {
+	status := &DBStatus{}
+	// recent writes may not be checkpointed into the database file yet
+	for _, path := range []string{dbs.dbPath, dbs.dbPath + "-wal"} {
+		if info, err := os.Stat(path); err == nil {
+			status.Size += info.Size()
+		}
+	}
+
+	var firstTime, lastTime sql.NullString
+	err := dbs.db.QueryRowContext(ctx, "SELECT count(1), min(time), max(time) FROM access_logs").Scan(&status.Entries, &firstTime, &lastTime)
+	if err != nil {
+		return nil, err
+	}
+	if status.FirstTime, err = parseNullTime(firstTime); err != nil {
+		return nil, err
+	}
+	if status.LastTime, err = parseNullTime(lastTime); err != nil {
+		return nil, err
+	}
+
+	rows, err := dbs.db.QueryContext(ctx, "SELECT path, lines, processed, skipped, skipped_samples, ingested_at FROM ingested_files ORDER BY rowid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		file := &FileStats{}
+		var samples string
+		var ingestedAt time.Time
+		if err := rows.Scan(&file.Path, &file.Lines, &file.Processed, &file.Skipped, &samples, &ingestedAt); err != nil {
+			return nil, err
+		}
+		if samples != "" {
+			file.SkippedSamples = strings.Split(samples, "\n")
+		}
+		status.IngestedAt = &ingestedAt
+		status.IngestedFiles = append(status.IngestedFiles, file)
+	}
+	return status, rows.Err()
+}
+
+// Parse a nullable time column value, returning nil if it's null.
+func parseNullTime(value sql.NullString) (*time.Time, error) {
+	if !value.Valid {
+		return nil, nil
+	}
+	t, err := time.Parse(DB_DATE_LAYOUT, value.String)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
@@ -0,0 +1,101 @@
+package ngtop
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Get the request counts of the given results of the spec query over evenly spaced buckets of its time window,
+// e.g. to tell whether they were steadily requested or had a spike.
+// The results are identified by the values of their fields, so rows like the (other) one just get zero counts.
+// Only the log entries table is queried, so the counts of pruned logs are not included.
+func (dbs *DBSession) QueryTrends(ctx context.Context, spec *RequestCountSpec, rows [][]string, buckets int) ([][]int, error) {
+	trends := make([][]int, len(rows))
+	for i := range rows {
+		trends[i] = make([]int, buckets)
+	}
+
+	// when querying all the logs, start from the first entry instead of the zero time
+	segment := querySegment{table: "access_logs", since: spec.TimeSince, until: spec.TimeUntil}
+	if segment.since.IsZero() {
+		var firstTime sql.NullString
+		if err := dbs.db.QueryRowContext(ctx, "SELECT min(time) FROM access_logs").Scan(&firstTime); err != nil {
+			return nil, err
+		}
+		first, err := parseNullTime(firstTime)
+		if err != nil || first == nil {
+			return trends, err
+		}
+		segment.since = *first
+		segment.sinceInclusive = true
+	}
+	window := int64(segment.until.Sub(segment.since).Seconds())
+	if len(rows) == 0 || window <= 0 {
+		return trends, nil
+	}
+
+	// the pivot field is shown as columns, so it doesn't identify the rows
+	fields := spec.GroupByMetrics
+	if spec.PivotMetric != "" {
+		fields = fields[:len(fields)-1]
+	}
+
+	// compare the values as text, since that's how they are returned by QueryTop
+	var columns []string
+	for _, column := range fields {
+		expression := columnExpression(column, spec.Location)
+		if expression == column {
+			expression = dbs.dictionaries.valueExpression(column)
+		}
+		columns = append(columns, fmt.Sprintf("coalesce(CAST(%s AS TEXT), '')", expression))
+	}
+
+	whereExpression, queryArgs := spec.whereExpression(segment, dbs.dictionaries)
+	if len(columns) > 0 {
+		rowConditions := make([]string, len(rows))
+		for i, row := range rows {
+			conditions := make([]string, len(columns))
+			for j, column := range columns {
+				conditions[j] = column + " = ?"
+				queryArgs = append(queryArgs, row[j])
+			}
+			rowConditions[i] = "(" + strings.Join(conditions, " AND ") + ")"
+		}
+		whereExpression += "AND (" + strings.Join(rowConditions, " OR ") + ") "
+	}
+
+	groupBy := make([]string, len(columns)+1)
+	for i := range groupBy {
+		groupBy[i] = strconv.Itoa(i + 1)
+	}
+	bucketExpression := fmt.Sprintf("(unixepoch(time) - %d) * %d / %d", segment.since.Unix(), buckets, window)
+	query := fmt.Sprintf(
+		"SELECT %s FROM access_logs %s GROUP BY %s",
+		strings.Join(append(columns, bucketExpression, "count(1)"), ", "),
+		whereExpression,
+		strings.Join(groupBy, ", "),
+	)
+	log.Printf("query: %s %s\n", query, queryArgs)
+	_, bucketRows, err := dbs.queryStrings(ctx, query, queryArgs...)
+	if err != nil {
+		return nil, err
+	}
+
+	rowIndexes := make(map[string]int)
+	for i, row := range rows {
+		rowIndexes[strings.Join(row[:len(fields)], "\x00")] = i
+	}
+	for _, bucketRow := range bucketRows {
+		i, found := rowIndexes[strings.Join(bucketRow[:len(fields)], "\x00")]
+		bucket, _ := strconv.Atoi(bucketRow[len(fields)])
+		count, _ := strconv.Atoi(bucketRow[len(fields)+1])
+		if found && bucket >= 0 && bucket < buckets {
+			trends[i][bucket] += count
+		}
+	}
+	return trends, nil
+}
@@ -0,0 +1,103 @@
+package ngtop
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The name of the view of the log entries with their dictionary values decoded and the virtual time fields
+// computed, so they can be queried with plain SQL, e.g. `SELECT path, count(1) FROM v_requests GROUP BY path`.
+const REQUESTS_VIEW = "v_requests"
+
+// The tables and views of the database, with a description of their contents, as documented by the schema command.
+var SCHEMA_TABLES = []struct {
+	Name        string
+	Description string
+}{
+	{REQUESTS_VIEW, "One row per log entry, with a column per field. Times, and the hour, weekday, date and month computed from them, are in UTC."},
+	{"access_logs", "The stored log entries. Columns of repeated values hold ids of their dict_<column> table."},
+	{"dict_<column>", "The distinct values of dictionary-encoded columns, by id."},
+	{"rollup_hourly", "Request counts by hour and common fields, when NGTOP_ROLLUPS is set."},
+	{"rollup_daily", "Request counts by day and common fields, when NGTOP_ROLLUPS is set."},
+	{"rejected_lines", "Log lines that couldn't be parsed, with the reason they were rejected."},
+	{"ingested_files", "The log files read by the last update."},
+}
+
+// Create or replace the helper views, whose columns depend on the ones of the access_logs table.
+// The views are only replaced when their definition changes, so there's usually nothing to write.
+func syncViews(db *sql.DB, dicts dictionaries) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info('access_logs') ORDER BY cid")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		columns = append(columns, name)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	viewSQL := requestsViewSQL(columns, dicts)
+	var currentSQL string
+	err = db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'view' AND name = ?", REQUESTS_VIEW).Scan(&currentSQL)
+	if err == nil && currentSQL == viewSQL {
+		return nil
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	log.Printf("query: %s\n", viewSQL)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DROP VIEW IF EXISTS " + REQUESTS_VIEW); err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+	if _, err := tx.Exec(viewSQL); err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+	return tx.Commit()
+}
+
+// Returns the name of the given access_logs column in the requests view. The raw values that other fields are
+// derived from are named after their log format variable, e.g. `request` for `request_raw`.
+func ViewColumnName(column string) string {
+	if field, found := COLUMN_NAME_TO_FIELD[column]; found && len(field.DerivedFields) > 0 {
+		return field.LogFormatVar
+	}
+	return column
+}
+
+// Returns the statement to create the requests view from the given access_logs columns.
+// Virtual fields are computed in UTC, so the view can be queried without the functions of the ngtop driver.
+func requestsViewSQL(columns []string, dicts dictionaries) string {
+	expressions := []string{"access_logs.id id"}
+	for _, column := range columns {
+		if column == "id" || column == "created" {
+			continue
+		}
+		expression := dicts.valueExpression(column)
+		if name := ViewColumnName(column); expression != name {
+			expression += " " + name
+		}
+		expressions = append(expressions, expression)
+	}
+	for _, field := range KNOWN_FIELDS {
+		if field.Expression != "" && !slices.Contains(columns, field.ColumnName) {
+			expressions = append(expressions, columnExpression(field.ColumnName, time.UTC)+" "+field.ColumnName)
+		}
+	}
+	return fmt.Sprintf("CREATE VIEW %s AS SELECT %s FROM access_logs", REQUESTS_VIEW, strings.Join(expressions, ", "))
+}
@@ -0,0 +1,65 @@
+package ngtop
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRequestsView(t *testing.T) {
+	dbFile, err := os.CreateTemp("", "ngtop.db")
+	assertEqual(t, err, nil)
+	defer os.Remove(dbFile.Name())
+
+	parser := NewParser(`$remote_addr [$time_iso8601] "$request" $status`)
+	dbs, err := InitDB(dbFile.Name(), parser.Fields)
+	assertEqual(t, err, nil)
+	err = dbs.PrepareForInsert(context.Background())
+	assertEqual(t, err, nil)
+	values, err := parser.ParseRecord(map[string]string{"message": `xx.xx.xx.xx [2024-07-23T21:00:49-03:00] "GET /feed HTTP/1.1" 301`})
+	assertEqual(t, err, nil)
+	err = dbs.FinishUpdate(dbs.AddLogEntry(values))
+	assertEqual(t, err, nil)
+
+	// dictionary values are decoded, raw columns named after their variable and times are in UTC
+	_, rows, err := dbs.QuerySQL(context.Background(), "SELECT CAST(time AS TEXT), request, method, path, status, weekday, date FROM v_requests")
+	assertEqual(t, err, nil)
+	assertEqual(t, rows, [][]string{{"2024-07-24 00:00:49+00:00", "GET /feed HTTP/1.1", "GET", "/feed", "301", "wed", "2024-07-24"}})
+	dbs.Close()
+
+	// the view is updated when the log format adds columns
+	parser = NewParser(`$remote_addr [$time_iso8601] "$request" $status $scheme`)
+	dbs, err = InitDB(dbFile.Name(), parser.Fields)
+	assertEqual(t, err, nil)
+	defer dbs.Close()
+	_, rows, err = dbs.QuerySQL(context.Background(), "SELECT path, scheme FROM v_requests")
+	assertEqual(t, err, nil)
+	assertEqual(t, rows, [][]string{{"/feed", ""}})
+}
+
+func TestReadOnlySQL(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "ngtop.db")
+	dbs, err := InitDB(dbPath, NewParser(DEFAULT_LOG_FORMAT).Fields)
+	assertEqual(t, err, nil)
+	dbs.Close()
+
+	dbs, err = OpenReadOnly(dbPath)
+	assertEqual(t, err, nil)
+	defer dbs.Close()
+
+	// queries can't write to the db, nor create other files
+	_, _, err = dbs.QuerySQL(context.Background(), "DELETE FROM access_logs")
+	assert(t, err != nil)
+	attachedPath := filepath.Join(dir, "attached.db")
+	_, _, err = dbs.QuerySQL(context.Background(), "ATTACH DATABASE '"+attachedPath+"' AS attached")
+	assert(t, err != nil)
+	_, err = os.Stat(attachedPath)
+	assert(t, os.IsNotExist(err))
+	vacuumPath := filepath.Join(dir, "vacuum.db")
+	_, _, err = dbs.QuerySQL(context.Background(), "VACUUM INTO '"+vacuumPath+"'")
+	assert(t, err != nil)
+	_, err = os.Stat(vacuumPath)
+	assert(t, os.IsNotExist(err))
+}
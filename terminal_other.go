@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package main
+
+// The terminal size isn't looked up on this platform, so the default output width is used.
+func terminalWidth() int {
+	return 0
+}